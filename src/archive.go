@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+//parquet的行组大小，整个行组在内存中编码
+const parquetRowGroupSize = 16 << 20
+
+//每个分区一个parquet文件，之后归档的源文件的行组追加到后面
+const parquetPartitionFile = "data.parquet"
+
+//parquet文件尾的元数据，已经归档的源文件内容的hash，逗号分隔
+const parquetSourcesKey = "tlogsync.sources"
+
+var errParquetSchema = errors.New("字段和分区文件不一致")
+
+//同时归档到同一个分区时按顺序追加
+var archiveLock sync.Mutex
+
+//转换中的一个源文件在一个分区的行，先写临时文件，全部写完再追加到分区文件
+type parquetArchive struct {
+	path   string //分区文件
+	file   *os.File
+	writer *writer.CSVWriter
+	hash   hash.Hash //写入的日志的hash
+	rows   int
+}
+
+//把同步完的文件转换成parquet，按日志、版本和月份分区，每个分区一个文件
+//目录结构为 backupdir/日志名/version=版本/month=YYYYMM/data.parquet，离线工具可以按分区读取
+func (s *LogSync) archiveFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := newDecompressReader(file, compressName(path))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	archives := make(map[string]*parquetArchive)
+	closeAll := func() {
+		for _, archive := range archives {
+			archive.file.Close()
+			os.Remove(archive.file.Name())
+		}
+	}
+	buff := bufio.NewReader(r)
+	lineno := 0
+	for {
+		line, err := buff.ReadString('\n')
+		if err != nil && err != io.EOF {
+			closeAll()
+			return err
+		}
+		if len(line) > 0 {
+			lineno++
+		}
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			//被拒绝的行已经写到死信目录
+			if args, tlogModel, _, checkErr := checkTlog(line); checkErr == nil {
+				month := time.Unix(atoi64(args[2]), 0).Format("200601")
+				archivePath := filepath.Join(config.Ini.Tlog.BackupDir, tlogModel.Name,
+					fmt.Sprintf("version=%d", tlogModel.Version), "month="+month, parquetPartitionFile)
+				archive, ok := archives[archivePath]
+				if !ok {
+					if archive, err = newParquetArchive(archivePath, tlogModel); err != nil {
+						closeAll()
+						return err
+					}
+					archives[archivePath] = archive
+				}
+				values, err := tlogModel.ParquetRow(args, dedupSource(path, lineno))
+				if err == nil {
+					err = archive.writer.WriteString(values)
+				}
+				if err != nil {
+					closeAll()
+					return fmt.Errorf("%s 第%d行 %s", archivePath, archive.rows+1, err.Error())
+				}
+				archive.hash.Write([]byte(line + "\n"))
+				archive.rows++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	for _, archive := range archives {
+		archivePath, err := archive.close()
+		delete(archives, archive.path)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		log.Println("归档文件", path, "=>", archivePath, "行数", archive.rows)
+	}
+	return os.Remove(path)
+}
+
+func newParquetArchive(path string, tlogModel *db.TlogModel) (*parquetArchive, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	w, err := writer.NewCSVWriterFromWriter(tlogModel.ParquetSchema(), file, 1)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	w.RowGroupSize = parquetRowGroupSize
+	switch config.Ini.Tlog.ArchiveCompression {
+	case "gzip":
+		w.CompressionType = parquet.CompressionCodec_GZIP
+	case "zstd":
+		w.CompressionType = parquet.CompressionCodec_ZSTD
+	default:
+		w.CompressionType = parquet.CompressionCodec_SNAPPY
+	}
+	return &parquetArchive{
+		path:   path,
+		file:   file,
+		writer: w,
+		hash:   sha1.New(),
+	}, nil
+}
+
+//写入文件尾，分区还没有文件的话改名成分区文件，有的话追加到后面
+//文件尾记录内容的hash，同一个文件重复归档(例如归档后删除源文件前中断)时不再追加
+//xml修改了这个版本的字段时不能追加，单独保存为 data_hash.parquet
+func (a *parquetArchive) close() (string, error) {
+	defer func() {
+		a.file.Close()
+		os.Remove(a.file.Name())
+	}()
+	sum := fmt.Sprintf("%x", a.hash.Sum(nil)[:6])
+	a.writer.Footer.KeyValueMetadata = append(a.writer.Footer.KeyValueMetadata, &parquet.KeyValue{Key: parquetSourcesKey, Value: &sum})
+	if err := a.writer.WriteStop(); err != nil {
+		return "", err
+	}
+	archiveLock.Lock()
+	defer archiveLock.Unlock()
+	if _, err := os.Stat(a.path); err != nil && os.IsNotExist(err) {
+		return a.path, os.Rename(a.file.Name(), a.path)
+	}
+	err := appendParquet(a.path, a.file, sum)
+	if err == errParquetSchema {
+		path := fmt.Sprintf("%s_%s.parquet", strings.TrimSuffix(a.path, ".parquet"), sum)
+		log.Println(err.Error(), a.path, "单独保存", path)
+		return path, os.Rename(a.file.Name(), path)
+	}
+	return a.path, err
+}
+
+//把src的行组追加到分区文件后面，不重新编码，写到临时文件后替换分区文件
+//分区文件的内容位置不变，src去掉开头的PAR1后整体后移，行组里的位置加上偏移，文件尾合并
+func appendParquet(path string, src *os.File, sum string) error {
+	dst, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	dstFooter, dstFooterStart, err := readParquetFooter(dst)
+	if err != nil {
+		return fmt.Errorf("%s %s", path, err.Error())
+	}
+	sources := parquetSources(dstFooter)
+	for _, source := range sources {
+		if source == sum {
+			log.Println("已经归档过", path, sum)
+			return nil
+		}
+	}
+	srcFooter, srcFooterStart, err := readParquetFooter(src)
+	if err != nil {
+		return err
+	}
+	if !sameParquetSchema(dstFooter.Schema, srcFooter.Schema) {
+		return errParquetSchema
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tmp, dst, dstFooterStart); err != nil {
+		return err
+	}
+	if _, err := src.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tmp, src, srcFooterStart-4); err != nil {
+		return err
+	}
+	delta := dstFooterStart - 4
+	for _, rowGroup := range srcFooter.RowGroups {
+		shiftRowGroup(rowGroup, delta)
+		if rowGroup.Ordinal != nil {
+			ordinal := int16(len(dstFooter.RowGroups))
+			rowGroup.Ordinal = &ordinal
+		}
+		dstFooter.RowGroups = append(dstFooter.RowGroups, rowGroup)
+	}
+	dstFooter.NumRows += srcFooter.NumRows
+	setParquetSources(dstFooter, append(sources, sum))
+	if err := writeParquetFooter(tmp, dstFooter); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//文件尾: 元数据 元数据长度(4字节小端) PAR1，返回元数据和它开始的位置
+func readParquetFooter(file *os.File) (*parquet.FileMetaData, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 8)
+	if info.Size() < 12 {
+		return nil, 0, fmt.Errorf("不是parquet文件")
+	}
+	if _, err := file.ReadAt(buf, info.Size()-8); err != nil {
+		return nil, 0, err
+	}
+	if string(buf[4:]) != "PAR1" {
+		return nil, 0, fmt.Errorf("不是parquet文件")
+	}
+	start := info.Size() - 8 - int64(binary.LittleEndian.Uint32(buf[:4]))
+	if start < 4 {
+		return nil, 0, fmt.Errorf("parquet文件尾错误")
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	footer := parquet.NewFileMetaData()
+	protocol := thrift.NewTCompactProtocolFactory().GetProtocol(thrift.NewStreamTransportR(bufio.NewReader(file)))
+	if err := footer.Read(context.TODO(), protocol); err != nil {
+		return nil, 0, err
+	}
+	return footer, start, nil
+}
+
+func writeParquetFooter(w io.Writer, footer *parquet.FileMetaData) error {
+	ts := thrift.NewTSerializer()
+	ts.Protocol = thrift.NewTCompactProtocolFactory().GetProtocol(ts.Transport)
+	buf, err := ts.Write(context.TODO(), footer)
+	if err != nil {
+		return err
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(buf)))
+	for _, bs := range [][]byte{buf, size, []byte("PAR1")} {
+		if _, err := w.Write(bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//行组和列里的位置加上偏移，页索引里是页的位置，追加的行组不带页索引
+func shiftRowGroup(rowGroup *parquet.RowGroup, delta int64) {
+	shift := func(offset *int64) *int64 {
+		if offset == nil {
+			return nil
+		}
+		v := *offset + delta
+		return &v
+	}
+	rowGroup.FileOffset = shift(rowGroup.FileOffset)
+	for _, column := range rowGroup.Columns {
+		column.FileOffset += delta
+		if md := column.MetaData; md != nil {
+			md.DataPageOffset += delta
+			md.IndexPageOffset = shift(md.IndexPageOffset)
+			md.DictionaryPageOffset = shift(md.DictionaryPageOffset)
+			md.BloomFilterOffset = shift(md.BloomFilterOffset)
+		}
+		column.ColumnIndexOffset = nil
+		column.ColumnIndexLength = nil
+		column.OffsetIndexOffset = nil
+		column.OffsetIndexLength = nil
+	}
+}
+
+//字段名、类型和是否可以为NULL都相同才能追加，按编码后的内容比较
+func sameParquetSchema(a []*parquet.SchemaElement, b []*parquet.SchemaElement) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ts := thrift.NewTSerializer()
+	ts.Protocol = thrift.NewTCompactProtocolFactory().GetProtocol(ts.Transport)
+	for i := range a {
+		bufA, errA := ts.Write(context.TODO(), a[i])
+		bufB, errB := ts.Write(context.TODO(), b[i])
+		if errA != nil || errB != nil || !bytes.Equal(bufA, bufB) {
+			return false
+		}
+	}
+	return true
+}
+
+func parquetSources(footer *parquet.FileMetaData) []string {
+	for _, kv := range footer.KeyValueMetadata {
+		if kv.Key == parquetSourcesKey && kv.Value != nil && len(*kv.Value) > 0 {
+			return strings.Split(*kv.Value, ",")
+		}
+	}
+	return make([]string, 0)
+}
+
+func setParquetSources(footer *parquet.FileMetaData, sources []string) {
+	value := strings.Join(sources, ",")
+	for _, kv := range footer.KeyValueMetadata {
+		if kv.Key == parquetSourcesKey {
+			kv.Value = &value
+			return
+		}
+	}
+	footer.KeyValueMetadata = append(footer.KeyValueMetadata, &parquet.KeyValue{Key: parquetSourcesKey, Value: &value})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+const archiveTestXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="archivetest" version="1" comment="归档" sharding="month">
+        <field name="gameid" type="int(11)"     comment="游戏id"/>
+        <field name="userid" type="bigint"      comment="用户id"/>
+        <field name="ip"     type="varchar(32)" nullable="true" comment="ip"/>
+    </tlog>
+</xml>
+`
+
+//多个源文件归档到同一个分区的一个文件，同样内容的文件重复归档不会追加
+func TestArchiveParquetPartition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	if err := ioutil.WriteFile(path("tlog.xml"), []byte(archiveTestXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadModelXml(path("tlog.xml")); err != nil {
+		t.Fatal(err)
+	}
+	config.Ini.Tlog.Dir = path("tlog")
+	config.Ini.Tlog.BackupDir = path("tlogbak")
+	config.Ini.Tlog.ArchiveCompression = ""
+	if err := os.MkdirAll(path("tlog/server1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logtime := time.Date(2021, 1, 15, 0, 0, 0, 0, time.Local).Unix()
+	files := []struct {
+		name    string
+		userids []int
+	}{
+		{"svc_tlog_2021011500.log", []int{1, 2}},
+		{"svc_tlog_2021011501.log", []int{3}},
+		{"server1/svc_tlog_2021011500.log", []int{4, 5}},
+		//和第一个文件内容相同，当成已经归档过
+		{"server1/svc_tlog_2021011502.log", []int{1, 2}},
+	}
+	s := &LogSync{}
+	for _, file := range files {
+		lines := make([]string, 0)
+		for _, userid := range file.userids {
+			lines = append(lines, fmt.Sprintf("archivetest|1|%d|7|%d|", logtime, userid))
+		}
+		filename := filepath.Join(path("tlog"), file.name)
+		if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.archiveFile(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	partition := path("tlogbak/archivetest/version=1/month=202101")
+	names, err := filepath.Glob(filepath.Join(partition, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || filepath.Base(names[0]) != parquetPartitionFile {
+		t.Fatalf("分区里的文件 %v", names)
+	}
+	pf, err := local.NewLocalFileReader(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	pr, err := reader.NewParquetColumnReader(pf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+	if n := pr.GetNumRows(); n != 5 {
+		t.Fatalf("分区文件有%d行，应该是5行", n)
+	}
+	//version logtime createtime updatetime gameid userid ip
+	userids, _, _, err := pr.ReadColumnByIndex(5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(userids) != "[1 2 3 4 5]" {
+		t.Fatalf("userid %v", userids)
+	}
+	ips, _, _, err := pr.ReadColumnByIndex(6, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ips) != "[<nil> <nil> <nil> <nil> <nil>]" {
+		t.Fatalf("ip %v", ips)
+	}
+	if len(parquetSources(pr.Footer)) != 3 {
+		t.Fatalf("记录的源文件 %v", parquetSources(pr.Footer))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//清理备份目录的间隔
+const backupCleanInterval = 10 * time.Minute
+
+//压缩格式对应的扩展名
+func compressExt(path string) string {
+	if strings.HasSuffix(path, ".gz") {
+		return ".gz"
+	} else if strings.HasSuffix(path, ".zst") {
+		return ".zst"
+	}
+	return ""
+}
+
+func compressName(path string) string {
+	switch compressExt(path) {
+	case ".gz":
+		return "gzip"
+	case ".zst":
+		return "zstd"
+	default:
+		return ""
+	}
+}
+
+//解压读取，不压缩的话直接读取
+func newDecompressReader(r io.Reader, compress string) (io.ReadCloser, error) {
+	switch compress {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+//压缩到临时文件，写完再改名
+func compressFile(path string, backupPath string, compress string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpPath := backupPath + ".tmp"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	var w io.WriteCloser
+	if compress == "zstd" {
+		w, err = zstd.NewWriter(dst)
+	} else {
+		w, err = gzip.NewWriterLevel(dst, gzip.BestCompression)
+	}
+	if err == nil {
+		if _, err = io.Copy(w, src); err == nil {
+			err = w.Close()
+		}
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, backupPath)
+}
+
+//定时清理备份目录，删除超过保留天数的文件，总大小超过上限的话从最旧的开始删除
+//调用前shutDownGroup加1
+func (s *LogSync) cleanBackupLoop() {
+	defer s.shutDownGroup.Done()
+	if config.Ini.Tlog.BackupMaxAge <= 0 && config.Ini.Tlog.BackupMaxSize <= 0 {
+		return
+	}
+	defer log.Println("clean backup done")
+	tick := time.NewTicker(backupCleanInterval)
+	defer tick.Stop()
+	s.cleanBackupDir()
+	for {
+		select {
+		case <-tick.C:
+			{
+				s.cleanBackupDir()
+			}
+		case <-s.chDie:
+			{
+				return
+			}
+		}
+	}
+}
+
+type backupEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (s *LogSync) cleanBackupDir() {
+	dir := config.Ini.Tlog.BackupDir
+	entries := make([]*backupEntry, 0)
+	dirs := make([]string, 0)
+	var total int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != dir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		//正在写入的临时文件
+		if strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		entries = append(entries, &backupEntry{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
+	maxAge := time.Duration(config.Ini.Tlog.BackupMaxAge) * 24 * time.Hour
+	maxSize := config.Ini.Tlog.BackupMaxSize << 20
+	count := 0
+	for _, entry := range entries {
+		expired := maxAge > 0 && time.Since(entry.modTime) > maxAge
+		oversize := maxSize > 0 && total > maxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(entry.path); err != nil {
+			log.Println("删除备份失败", entry.path, err)
+			continue
+		}
+		total -= entry.size
+		count++
+	}
+	//从最深的开始删除空目录，刚创建的目录可能马上要写入
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, path := range dirs {
+		if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) < backupCleanInterval {
+			continue
+		}
+		if infos, err := os.ReadDir(path); err == nil && len(infos) <= 0 {
+			os.Remove(path)
+		}
+	}
+	if count > 0 {
+		log.Printf("清理备份目录 %s, 删除文件=%d, 剩余大小=%dMB\n", dir, count, total>>20)
+	}
+}
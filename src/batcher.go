@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//一种日志的批次协程，每个写入目标一个缓存，满了、跨月或者超时后交给这个目标的写入协程
+type tlogBatcher struct {
+	typ       string
+	lineChan  chan *tlogLine
+	flushChan chan chan bool
+	flushReq  chan bool              //请求尽快写入，不等待
+	logCache  map[*sinkOutput]*Cache //每个写入目标的缓存
+	oldest    int64                  //缓存里最早的日志的读取时间，UnixNano，给监控用
+}
+
+//每种日志第一次出现时启动它的批次协程
+func (s *LogSync) batcher(typ string) *tlogBatcher {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+	if b, ok := s.batchers[typ]; ok {
+		return b
+	}
+	b := &tlogBatcher{
+		typ:       typ,
+		lineChan:  make(chan *tlogLine, queueSize()),
+		flushChan: make(chan chan bool),
+		flushReq:  make(chan bool, 1),
+		logCache:  make(map[*sinkOutput]*Cache),
+	}
+	s.batchers[typ] = b
+	s.batchGroup.Add(1)
+	go s.batchLoop(b)
+	return b
+}
+
+func (s *LogSync) batchLoop(b *tlogBatcher) {
+	tick := time.NewTicker(time.Duration(config.Ini.Tlog.SyncTime) * time.Second)
+	defer func() {
+		tick.Stop()
+		s.batchGroup.Done()
+	}()
+	for {
+		select {
+		case line, ok := <-b.lineChan:
+			{
+				if !ok {
+					//退出时写入剩下的日志
+					b.flushAll()
+					return
+				}
+				b.push(line)
+			}
+		case ch := <-b.flushChan:
+			{
+				//先取出已经进入队列的日志
+				b.drain()
+				b.flushAll()
+				close(ch)
+			}
+		case <-b.flushReq:
+			{
+				b.drain()
+				b.flushAll()
+			}
+		case <-tick.C:
+			{
+				b.flushAll()
+			}
+		}
+	}
+}
+
+func (b *tlogBatcher) drain() {
+	for {
+		select {
+		case line, ok := <-b.lineChan:
+			if !ok {
+				return
+			}
+			b.push(line)
+		default:
+			return
+		}
+	}
+}
+
+//先加入缓存，一会批量写入
+func (b *tlogBatcher) push(tline *tlogLine) {
+	version := int32(tline.tlogModel.Version)
+	for _, out := range tline.outs {
+		cache, ok := b.logCache[out]
+		if ok && (!isSameMonth(cache.logtime, tline.logtime) || cache.version != version) {
+			//跨月的话，立刻刷新
+			b.flush(out, cache)
+		}
+		cache, ok = b.logCache[out]
+		if ok {
+			cache.push(tline)
+		} else {
+			cache = &Cache{
+				lines:      make([]*tlogLine, 0),
+				logtime:    tline.logtime,
+				version:    version,
+				tlogModel:  tline.tlogModel,
+				createTime: time.Now(),
+			}
+			cache.push(tline)
+			b.logCache[out] = cache
+			b.updateOldest()
+		}
+		metrics.CacheLines.WithLabelValues(out.name, b.typ).Set(float64(cache.len()))
+		if cache.len() >= config.Ini.Tlog.BatchWrite {
+			b.flush(out, cache)
+		}
+	}
+}
+
+//交给写入协程，写入协程的队列满了的话等待
+func (b *tlogBatcher) flush(out *sinkOutput, cache *Cache) {
+	//log.Println("刷新日志", b.typ, out.name, cache.len())
+	delete(b.logCache, out)
+	metrics.CacheLines.WithLabelValues(out.name, b.typ).Set(0)
+	b.updateOldest()
+	out.writer(b.typ).cacheChan <- cache
+}
+
+func (b *tlogBatcher) flushAll() {
+	for out, cache := range b.logCache {
+		b.flush(out, cache)
+	}
+}
+
+func (b *tlogBatcher) updateOldest() {
+	var oldest int64
+	for _, cache := range b.logCache {
+		if t := cache.createTime.UnixNano(); oldest == 0 || t < oldest {
+			oldest = t
+		}
+	}
+	atomic.StoreInt64(&b.oldest, oldest)
+}
+
+//把所有批次协程的缓存交给写入协程，换文件或者需要确认的批次马上写入
+func (s *LogSync) flushBatchers() {
+	log.Println("刷新全部日志")
+	s.batchLock.Lock()
+	batchers := make([]*tlogBatcher, 0, len(s.batchers))
+	for _, b := range s.batchers {
+		batchers = append(batchers, b)
+	}
+	s.batchLock.Unlock()
+	for _, b := range batchers {
+		ch := make(chan bool)
+		b.flushChan <- ch
+		<-ch
+	}
+}
+
+//请求所有批次协程尽快把缓存交给写入协程，不等待，写入慢的时候tcp链接不会阻塞
+func (s *LogSync) requestFlush() {
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+	for _, b := range s.batchers {
+		select {
+		case b.flushReq <- true:
+		default:
+		}
+	}
+}
+
+//停止所有批次协程和写入协程，调用前所有来源都要已经停止
+func (s *LogSync) stopPipeline() {
+	s.batchLock.Lock()
+	for _, b := range s.batchers {
+		close(b.lineChan)
+	}
+	s.batchLock.Unlock()
+	s.batchGroup.Wait()
+	for _, out := range s.outputs {
+		out.stop()
+	}
+}
+
+//缓存和写入队列里最早的日志的读取时间
+func (s *LogSync) updateOldestUnflushed() {
+	var oldest int64
+	s.batchLock.Lock()
+	for _, b := range s.batchers {
+		if t := atomic.LoadInt64(&b.oldest); t > 0 && (oldest == 0 || t < oldest) {
+			oldest = t
+		}
+	}
+	s.batchLock.Unlock()
+	for _, out := range s.outputs {
+		for _, w := range out.allWriters() {
+			if t := atomic.LoadInt64(&w.oldest); t > 0 && (oldest == 0 || t < oldest) {
+				oldest = t
+			}
+		}
+	}
+	if oldest == 0 {
+		metrics.SetOldestUnflushed(time.Time{})
+		return
+	}
+	metrics.SetOldestUnflushed(time.Unix(0, oldest))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+//文件同步进度
+type checkpoint struct {
+	Path   string `json:"path"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	Line   int    `json:"line"`
+}
+
+//同步进度存储，保存在本地文件，多个写入协程会同时提交
+type checkpointStore struct {
+	lock     sync.Mutex
+	filename string
+	dict     map[string]*checkpoint
+}
+
+//fallback是增加写入目标之前共用的进度文件，自己的进度文件还不存在时从它继续
+func newCheckpointStore(filename string, fallback string) (*checkpointStore, error) {
+	store := &checkpointStore{
+		filename: filename,
+		dict:     make(map[string]*checkpoint),
+	}
+	if len(filename) <= 0 {
+		return store, nil
+	}
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil && os.IsNotExist(err) && len(fallback) > 0 {
+		bs, err = ioutil.ReadFile(fallback)
+	}
+	if err != nil && os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	arr := make([]*checkpoint, 0)
+	if err := json.Unmarshal(bs, &arr); err != nil {
+		return nil, err
+	}
+	for _, cp := range arr {
+		store.dict[cp.Path] = cp
+	}
+	log.Printf("加载同步进度 %s, 文件数量=%d\n", filename, len(store.dict))
+	return store, nil
+}
+
+//已提交的偏移和行号，文件被替换时从头开始，文件被改名时按inode找回原来的进度
+func (c *checkpointStore) get(path string, inode uint64) (int64, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cp, ok := c.dict[path]
+	if ok && cp.Inode == inode {
+		return cp.Offset, cp.Line
+	}
+	if inode == 0 {
+		return 0, 0
+	}
+	for oldPath, cp := range c.dict {
+		if cp.Inode != inode {
+			continue
+		}
+		if info, err := os.Stat(oldPath); err == nil && fileInode(info) == inode {
+			continue
+		}
+		log.Println("文件被改名", oldPath, "=>", path)
+		delete(c.dict, oldPath)
+		return cp.Offset, cp.Line
+	}
+	return 0, 0
+}
+
+func (c *checkpointStore) commit(path string, inode uint64, offset int64, line int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cp, ok := c.dict[path]
+	if ok && cp.Inode == inode && cp.Offset == offset {
+		return nil
+	}
+	c.dict[path] = &checkpoint{
+		Path:   path,
+		Inode:  inode,
+		Offset: offset,
+		Line:   line,
+	}
+	return c.save()
+}
+
+func (c *checkpointStore) remove(path string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.dict[path]; !ok {
+		return nil
+	}
+	delete(c.dict, path)
+	return c.save()
+}
+
+//删除已经不存在的文件的进度
+func (c *checkpointStore) prune() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := false
+	for path := range c.dict {
+		if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
+			delete(c.dict, path)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.save()
+}
+
+//先写临时文件再改名，避免写一半进程退出
+func (c *checkpointStore) save() error {
+	if len(c.filename) <= 0 {
+		return nil
+	}
+	arr := make([]*checkpoint, 0)
+	for _, cp := range c.dict {
+		arr = append(arr, cp)
+	}
+	bs, err := json.MarshalIndent(arr, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpFilename := c.filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, c.filename)
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
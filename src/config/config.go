@@ -20,27 +20,81 @@ var Ini struct {
 		Db       string `ini:"db"`
 		Charset  string `ini:"charset"`
 	} `ini:"mysql"`
+	Postgres struct {
+		Host     string `ini:"host"`
+		Port     int    `ini:"port"`
+		User     string `ini:"user"`
+		Password string `ini:"password"`
+		Db       string `ini:"db"`
+		SslMode  string `ini:"sslmode"`
+	} `ini:"postgres"`
+	ClickHouse struct {
+		Addr     string `ini:"addr"`
+		User     string `ini:"user"`
+		Password string `ini:"password"`
+		Db       string `ini:"db"`
+	} `ini:"clickhouse"`
+	Sqlite struct {
+		File string `ini:"file"`
+	} `ini:"sqlite"`
+	Kafka struct {
+		Brokers       string `ini:"brokers"`
+		TopicPrefix   string `ini:"topicprefix"`
+		Encoding      string `ini:"encoding"`
+		ConsumeTopics string `ini:"consumetopics"`
+		ConsumeGroup  string `ini:"consumegroup"`
+	} `ini:"kafka"`
 
 	Tlog struct {
-		Dir             string `ini:"dir"`
-		BackupDir       string `ini:"backupdir"`
-		BatchWrite      int    `ini:"batchwrite"`
-		SyncTime        int64  `ini:"synctime"`
-		Listen          string `ini:"listen"`
-		LogXml          string `ini:"logxml"`
-		AutoCreateTable bool   `ini:"autocreatetable"`
-		AutoAddColumn   bool   `ini:"autoaddcolumn"`
+		Dir                string `ini:"dir"`
+		BackupDir          string `ini:"backupdir"`
+		Archive            string `ini:"archive"`
+		ArchiveCompression string `ini:"archivecompression"`
+		BackupCompress     string `ini:"backupcompress"`
+		BackupMaxAge       int64  `ini:"backupmaxage"`
+		BackupMaxSize      int64  `ini:"backupmaxsize"`
+		BatchWrite         int    `ini:"batchwrite"`
+		Writers            int    `ini:"writers"`
+		QueueSize          int    `ini:"queuesize"`
+		SyncTime           int64  `ini:"synctime"`
+		Listen             string `ini:"listen"`
+		LogXml             string `ini:"logxml"`
+		AutoCreateTable    bool   `ini:"autocreatetable"`
+		AutoAddColumn      bool   `ini:"autoaddcolumn"`
+		Checkpoint         string `ini:"checkpoint"`
+		Tail               bool   `ini:"tail"`
+		IdleTime           int64  `ini:"idletime"`
+		RetryDir           string `ini:"retrydir"`
+		RetryMemory        int    `ini:"retrymemory"`
+		RetryMaxInterval   int64  `ini:"retrymaxinterval"`
+		RetryMaxAttempts   int    `ini:"retrymaxattempts"`
+		DeadLetterDir      string `ini:"deadletterdir"`
+		Protocol           string `ini:"protocol"`
+		SpoolDir           string `ini:"spooldir"`
+		SpoolMaxSize       int64  `ini:"spoolmaxsize"`
+		RateLimit          int    `ini:"ratelimit"`
+		UdpListen          string `ini:"udplisten"`
+		UdpSyslog          bool   `ini:"udpsyslog"`
+		ReloadXml          bool   `ini:"reloadxml"`
+		Sink               string `ini:"sink"`
 	} `ini:"tlog"`
+
+	Http struct {
+		Listen  string `ini:"listen"`
+		Path    string `ini:"path"`
+		Metrics string `ini:"metrics"`
+	} `ini:"http"`
 }
 
-func init() {
-	err := ini.MapTo(&Ini, "config.ini")
-	if err != nil {
-		panic(err)
+//加载配置文件，启动时最先调用，其它包都在这之后读取配置
+func Load(path string) error {
+	if err := ini.MapTo(&Ini, path); err != nil {
+		return err
 	}
 	str, err := json.MarshalIndent(Ini, "", "\t")
 	if err != nil {
-		panic(err)
+		return err
 	}
 	log.Printf("[config] %s\n", str)
+	return nil
 }
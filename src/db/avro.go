@@ -0,0 +1,115 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+//avro单对象编码: C3 01 + schema指纹(CRC-64-AVRO，小端8字节) + 二进制数据
+//消费者按指纹找到 日志名v版本 对应的schema，schema由xml生成
+var avroMagic = []byte{0xC3, 0x01}
+
+const avroEmpty = 0xc15d213aa4d7a795
+
+var avroFingerprintTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := 0; i < 256; i++ {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (avroEmpty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	return table
+}()
+
+func avroFingerprint(schema string) uint64 {
+	fp := uint64(avroEmpty)
+	for i := 0; i < len(schema); i++ {
+		fp = (fp >> 8) ^ avroFingerprintTable[byte(fp)^schema[i]]
+	}
+	return fp
+}
+
+//bigint unsigned超过long的范围，写成十进制字符串
+func avroUnsignedLong(field *TlogField) bool {
+	return field.kind() == fieldInt && field.typ.unsigned && field.typ.bits >= 64
+}
+
+//可以为NULL的字段为 ["null", 类型] 的union
+func avroType(field *TlogField) interface{} {
+	typ := "string"
+	switch field.kind() {
+	case fieldInt:
+		if !avroUnsignedLong(field) {
+			typ = "long"
+		}
+	case fieldFloat:
+		typ = "double"
+	}
+	if field.Nullable {
+		return []string{"null", typ}
+	}
+	return typ
+}
+
+//直接生成规范格式(Parsing Canonical Form)，指纹按这个字符串计算
+func (tlog *TlogModel) avroSchema() string {
+	type avroField struct {
+		Name string      `json:"name"`
+		Type interface{} `json:"type"`
+	}
+	type avroRecord struct {
+		Name   string      `json:"name"`
+		Type   string      `json:"type"`
+		Fields []avroField `json:"fields"`
+	}
+	record := avroRecord{
+		Name:   "tlog." + tlog.VerName,
+		Type:   "record",
+		Fields: make([]avroField, 0),
+	}
+	for _, field := range tlog.FieldArr {
+		record.Fields = append(record.Fields, avroField{Name: field.Name, Type: avroType(field)})
+	}
+	bs, _ := json.Marshal(record)
+	return string(bs)
+}
+
+//values已经按字段类型转换过，long和字符串长度是zigzag变长编码，double是小端8字节
+//union先写分支的序号，null为0，值为1
+func (tlog *TlogModel) avroEncode(fingerprint uint64, values []interface{}) ([]byte, error) {
+	buff := make([]byte, 0, 64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buff = append(buff, avroMagic...)
+	binary.LittleEndian.PutUint64(tmp, fingerprint)
+	buff = append(buff, tmp[:8]...)
+	for i, field := range tlog.FieldArr {
+		if field.Nullable {
+			if values[i] == nil {
+				buff = append(buff, tmp[:binary.PutVarint(tmp, 0)]...)
+				continue
+			}
+			buff = append(buff, tmp[:binary.PutVarint(tmp, 1)]...)
+		}
+		value := values[i]
+		if avroUnsignedLong(field) {
+			value = fmt.Sprint(value)
+		}
+		switch v := value.(type) {
+		case int64:
+			buff = append(buff, tmp[:binary.PutVarint(tmp, v)]...)
+		case float64:
+			binary.LittleEndian.PutUint64(tmp, math.Float64bits(v))
+			buff = append(buff, tmp[:8]...)
+		case string:
+			buff = append(buff, tmp[:binary.PutVarint(tmp, int64(len(v)))]...)
+			buff = append(buff, v...)
+		default:
+			return nil, fmt.Errorf("字段 %s 类型错误 %T", field.Name, values[i])
+		}
+	}
+	return buff, nil
+}
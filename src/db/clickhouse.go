@@ -0,0 +1,210 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//按月分表的日志不加后缀，建成按toYYYYMM(logtime)分区的MergeTree表
+type clickhouseSink struct {
+	db *sql.DB
+}
+
+func newClickhouseSink() (Sink, error) {
+	addr := fmt.Sprintf("tcp://%s?username=%s&password=%s&database=%s",
+		config.Ini.ClickHouse.Addr, config.Ini.ClickHouse.User, config.Ini.ClickHouse.Password, config.Ini.ClickHouse.Db)
+	db, err := sql.Open("clickhouse", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	log.Printf("连接数据库成功 clickhouse %s/%s\n", config.Ini.ClickHouse.Addr, config.Ini.ClickHouse.Db)
+	return &clickhouseSink{db: db}, nil
+}
+
+func (s *clickhouseSink) Name() string {
+	return "clickhouse"
+}
+
+func (s *clickhouseSink) CreateTable(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	log.Println("检查创建表", tableName)
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n", tableName)
+	for _, field := range tlogModel.FieldArr {
+		sql = sql + fmt.Sprintf("\t%s,\n", clickhouseColumnSql(field))
+	}
+	sql = strings.TrimSuffix(sql, ",\n") + "\n)"
+	if tlogModel.Sharding == "month" {
+		sql = sql + " ENGINE = MergeTree() PARTITION BY toYYYYMM(toDateTime(logtime)) ORDER BY (logtime)"
+	} else {
+		sql = sql + " ENGINE = MergeTree() ORDER BY (logtime)"
+	}
+	if _, err := s.db.Exec(sql); err != nil {
+		log.Println(sql)
+		log.Printf("创建表失败, 原因=%s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *clickhouseSink) AddColumn(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	log.Println("检查增加列", tableName)
+	//检查是否有新字段
+	for _, field := range tlogModel.FieldArr {
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", tableName, clickhouseColumnSql(field))
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Println(sql)
+			log.Printf("修改表失败, 原因=%s\n", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+//clickhouse没有普通索引和唯一索引，logtime已经是排序键，其它单列索引建bloom_filter跳数索引
+//多列索引和唯一索引不创建
+func (s *clickhouseSink) AddIndex(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	for _, index := range tlogModel.indexes {
+		if len(index.columnArr) != 1 || index.Unique || index.columnArr[0] == "logtime" {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD INDEX IF NOT EXISTS %s %s TYPE bloom_filter GRANULARITY 4", tableName, index.Name, index.columnArr[0])
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Println(sql)
+			log.Printf("添加索引失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+//在一个事务里逐行Exec，驱动在Commit时按列组成一个block发送
+func (s *clickhouseSink) Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error {
+	now := time.Now().Unix()
+	tableName := strings.ToLower(tlogModel.Name)
+	placeholderArr := make([]string, 0)
+	for range tlogModel.FieldArr {
+		placeholderArr = append(placeholderArr, "?")
+	}
+	sql := fmt.Sprintf("INSERT INTO %s %s VALUES (%s)", tableName, tlogModel.fieldSql, strings.Join(placeholderArr, ","))
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("db.clickhouseSink.Insert err %+v\n", err)
+		return err
+	}
+	stmt, err := tx.Prepare(sql)
+	if err != nil {
+		log.Printf("db.clickhouseSink.Insert err %+v\n", err)
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i, row := range rows {
+		args, err := tlogModel.formInsertArgs(row, sources[i], now)
+		if err != nil {
+			log.Printf("db.clickhouseSink.Insert err %+v\n", err)
+			tx.Rollback()
+			return err
+		}
+		for j, field := range tlogModel.FieldArr {
+			args[j] = clickhouseValue(field, args[j])
+		}
+		debugSql(sql, args)
+		if _, err := stmt.Exec(args...); err != nil {
+			log.Printf("db.clickhouseSink.Insert err %+v\n", err)
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db.clickhouseSink.Insert err %+v\n", err)
+		return err
+	}
+	return nil
+}
+
+//xml里是mysql的类型，转成clickhouse的类型，驱动只支持到Decimal(38,s)，更大的用Float64
+func clickhouseType(field *TlogField) string {
+	t := field.typ
+	switch t.kind {
+	case fieldInt:
+		prefix := "Int"
+		if t.unsigned {
+			prefix = "UInt"
+		}
+		if t.bits == 24 {
+			return prefix + "32"
+		}
+		return fmt.Sprintf("%s%d", prefix, t.bits)
+	case fieldFloat:
+		switch {
+		case t.name == "float":
+			return "Float32"
+		case t.name == "double" || t.precision > 38:
+			return "Float64"
+		case t.precision > 0:
+			return fmt.Sprintf("Decimal(%d,%d)", t.precision, t.scale)
+		default:
+			return "Decimal(10,0)"
+		}
+	case fieldDatetime:
+		return "DateTime"
+	default:
+		return "String"
+	}
+}
+
+func clickhouseColumnSql(field *TlogField) string {
+	typ := clickhouseType(field)
+	if field.Nullable {
+		typ = "Nullable(" + typ + ")"
+	}
+	def := "NULL"
+	switch v := field.columnDefault().(type) {
+	case nil:
+	case string:
+		if field.kind() == fieldDatetime {
+			t, _ := time.ParseInLocation(datetimeLayout, v, time.Local)
+			def = fmt.Sprintf("toDateTime(%d)", t.Unix())
+		} else {
+			def = clickhouseQuote(v)
+		}
+	default:
+		def = fmt.Sprint(v)
+	}
+	return fmt.Sprintf("%s %s DEFAULT %s COMMENT %s", field.Name, typ, def, clickhouseQuote(field.Comment))
+}
+
+//驱动按列的类型编码，值已经按字段类型转换过，写到String列的数字转成字符串
+//datetime按本地时间转成time.Time，不让驱动按服务器时区解析
+func clickhouseValue(field *TlogField, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		if clickhouseType(field) == "String" {
+			return fmt.Sprint(v)
+		}
+		return v
+	}
+	if field.kind() == fieldDatetime {
+		if t, err := time.ParseInLocation(datetimeLayout, str, time.Local); err == nil {
+			return t
+		}
+	}
+	return str
+}
+
+func clickhouseQuote(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "'", "\\'", -1) + "'"
+}
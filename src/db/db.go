@@ -1,65 +1,62 @@
 package db
 
 import (
+	"crypto/sha1"
 	"fmt"
 	"log"
 	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
 	"github.com/shark/minigame-tlogsync/config"
 )
 
-var db *sqlx.DB
-
-func init() {
-	addr := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s",
-		config.Ini.MySql.User, config.Ini.MySql.Password, config.Ini.MySql.Ip, config.Ini.MySql.Port, config.Ini.MySql.Db, config.Ini.MySql.Charset)
+//连接写入目标，加载xml，在配置加载之后调用
+func Init() error {
 	var err error
-	db, err = sqlx.Open("mysql", addr)
-	if err != nil {
-		panic(err)
-	}
-	err = db.Ping()
+	sinks, err = newSinks(config.Ini.Tlog.Sink)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	log.Printf("连接数据库成功 %+v\n", addr)
-	if err := loadModelXml(config.Ini.Tlog.LogXml); err != nil {
-		panic(err)
+	if _, err := loadModelXml(config.Ini.Tlog.LogXml); err != nil {
+		return err
 	}
-	syncDatabase2()
+	return nil
+}
+
+//建当月和下月的表，按配置增加xml中新加的列，之后定时再建
+//-migrate只对比表结构，不调用，不会改动数据库
+func SyncDatabase() {
+	syncDatabase2(latestModels())
 	go forkSyncDatabase()
 }
 
 func forkSyncDatabase() {
 	for {
 		time.Sleep(10 * 24 * time.Hour)
-		syncDatabase2()
+		syncDatabase2(latestModels())
 	}
 }
 
-func syncDatabase2() error {
+func syncDatabase2(models []*TlogModel) error {
 	//当月
 	monthTime := time.Now()
 	month := monthTime.Year()*100 + int(monthTime.Month())
 	//log.Println("建表", month)
-	syncDatabase(month)
+	syncDatabase(month, models)
 	//下月
 	nextMonthTime := time.Now().AddDate(0, 1, 0)
 	nextMonth := nextMonthTime.Year()*100 + int(nextMonthTime.Month())
 	//log.Println("建表", nextMonth)
-	syncDatabase(nextMonth)
+	syncDatabase(nextMonth, models)
 	return nil
 }
 
-func syncDatabase(suffix int) error {
+func syncDatabase(suffix int, models []*TlogModel) error {
 	if config.Ini.Tlog.AutoCreateTable {
-		autoCreateTable(suffix)
+		autoCreateTable(suffix, models)
 	}
 	if config.Ini.Tlog.AutoAddColumn {
-		autoAddColumn(suffix)
+		autoAddColumn(suffix, models)
 	}
 	return nil
 }
@@ -70,51 +67,58 @@ func logtime2Month(t int64) int {
 	return month
 }
 
-func tableIsExits(tableName string) bool {
-	_, err := db.Exec(fmt.Sprintf("desc %s", tableName))
-	if err == nil {
-		return true
+//一行日志写入的值，按字段类型转换，和fieldSql的顺序一致，source为去重的来源
+func (tlog *TlogModel) formInsertArgs(row []string, source string, now int64) ([]interface{}, error) {
+	if len(row) != len(tlog.LineFields())+3 {
+		return nil, &rowError{fmt.Errorf("日志不符合长度规则 长度要求:%d", len(tlog.LineFields())+2)}
+	}
+	args := make([]interface{}, 0, len(tlog.FieldArr))
+	for i, field := range tlog.FieldArr {
+		switch {
+		case field.Name == dedupColumn && len(tlog.Dedup) > 0:
+			args = append(args, tlog.dedupKey(args, source))
+		case i < 2:
+			//version logtime
+			v, err := field.value(row[i+1])
+			if err != nil {
+				return nil, &rowError{err}
+			}
+			args = append(args, v)
+		case i < 4:
+			//createtime updatetime
+			args = append(args, now)
+		default:
+			v, err := field.value(row[i-1])
+			if err != nil {
+				return nil, &rowError{err}
+			}
+			args = append(args, v)
+		}
 	}
-	return false
+	return args, nil
 }
 
-func Common_Insert(tlogModel *TlogModel, typ string, rows [][]string, logtime int64) error {
-	now := time.Now().Unix()
-	month := logtime2Month(logtime)
-	tableName := strings.ToLower(typ)
-	if tlogModel.Sharding == "month" {
-		tableName = fmt.Sprintf("%s_%d", strings.ToLower(typ), month)
-	}
-	sql := fmt.Sprintf("INSERT INTO %s %s VALUES ", tableName, tlogModel.fieldSql)
-	args0 := rows[0]
-	oneValueArr := make([]string, 0)
-	for i := 1; i < len(args0)+2; i++ {
-		oneValueArr = append(oneValueArr, "?")
-	}
-	valueStr := strings.Join(oneValueArr, ",")
-	valueStr = "(" + valueStr + ")"
-	valueArr := make([]string, 0)
-	for i := 0; i < len(rows); i++ {
-		valueArr = append(valueArr, valueStr)
+//去重键，来源或者字段的值的sha1，来源为空(不是来自文件)的话为NULL，不去重
+func (tlog *TlogModel) dedupKey(args []interface{}, source string) interface{} {
+	if tlog.Dedup == dedupSource {
+		if len(source) <= 0 {
+			return nil
+		}
+		return fmt.Sprintf("%x", sha1.Sum([]byte(source)))
 	}
-	sql = fmt.Sprintf("%s%s", sql, strings.Join(valueArr, ","))
-	args := make([]interface{}, 0)
-	for _, row := range rows {
-		args = append(args, row[1]) //version
-		args = append(args, row[2]) //logtime
-		args = append(args, now)    //createtime
-		args = append(args, now)    //updatetime
-		for _, v := range row[3:] {
-			args = append(args, v)
+	values := make([]string, 0, len(tlog.dedupArr))
+	for _, i := range tlog.dedupArr {
+		if args[i] == nil {
+			values = append(values, "\\N")
+		} else {
+			values = append(values, fmt.Sprint(args[i]))
 		}
 	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(values, "|"))))
+}
+
+func debugSql(sql string, args []interface{}) {
 	if config.Ini.Basic.Debug {
 		log.Println(sql, args)
 	}
-	_, err := db.Exec(sql, args...)
-	if err != nil {
-		log.Printf("db.Common_Insert err %+v\n", err)
-		return err
-	}
-	return nil
 }
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//字段的基本类型，写入不区分数据库类型的目标时使用
+const (
+	fieldInt      = "int"
+	fieldFloat    = "float"
+	fieldString   = "string"
+	fieldDatetime = "datetime"
+	fieldJson     = "json"
+)
+
+//写入datetime字段的格式，本地时间
+const datetimeLayout = "2006-01-02 15:04:05"
+
+//xml里的字段类型，加载xml时解析，写入前按类型检查和转换每个值，建表时转换成各个数据库的类型
+type fieldType struct {
+	name      string //去掉长度和unsigned的类型名
+	kind      string
+	unsigned  bool
+	bits      uint //整数的位数
+	precision int  //decimal(p,s)，没有写的话为0
+	scale     int
+	length    int   //varchar(N) char(N)的字符数
+	maxBytes  int64 //text的字节数，0不限制
+}
+
+var fieldIntRegexp = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|integer|bigint)(\(\d+\))?( unsigned)?$`)
+var fieldFloatRegexp = regexp.MustCompile(`^(float|double|decimal)(\((\d+)(,(\d+))?\))?( unsigned)?$`)
+var fieldCharRegexp = regexp.MustCompile(`^(varchar|char)\((\d+)\)$`)
+
+var fieldIntBits = map[string]uint{
+	"tinyint":   8,
+	"smallint":  16,
+	"mediumint": 24,
+	"int":       32,
+	"integer":   32,
+	"bigint":    64,
+}
+
+var fieldTextBytes = map[string]int64{
+	"tinytext":   255,
+	"text":       65535,
+	"mediumtext": 16777215,
+	"longtext":   0,
+}
+
+func parseFieldType(typ string) (*fieldType, error) {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	if m := fieldIntRegexp.FindStringSubmatch(typ); m != nil {
+		return &fieldType{name: m[1], kind: fieldInt, bits: fieldIntBits[m[1]], unsigned: len(m[3]) > 0}, nil
+	}
+	if m := fieldFloatRegexp.FindStringSubmatch(typ); m != nil {
+		t := &fieldType{name: m[1], kind: fieldFloat, unsigned: len(m[6]) > 0}
+		if m[1] == "decimal" && len(m[3]) > 0 {
+			t.precision, _ = strconv.Atoi(m[3])
+			t.scale, _ = strconv.Atoi(m[5])
+			if t.precision <= 0 || t.precision > 65 || t.scale > t.precision {
+				return nil, fmt.Errorf("decimal精度错误 %s", typ)
+			}
+		}
+		return t, nil
+	}
+	if m := fieldCharRegexp.FindStringSubmatch(typ); m != nil {
+		n, _ := strconv.Atoi(m[2])
+		return &fieldType{name: m[1], kind: fieldString, length: n}, nil
+	}
+	if n, ok := fieldTextBytes[typ]; ok {
+		return &fieldType{name: typ, kind: fieldString, maxBytes: n}, nil
+	}
+	switch typ {
+	case "datetime":
+		return &fieldType{name: typ, kind: fieldDatetime}, nil
+	case "json":
+		return &fieldType{name: typ, kind: fieldJson}, nil
+	}
+	return nil, fmt.Errorf("不支持的类型 %s", typ)
+}
+
+//text和json，mysql里不能有默认值
+func (t *fieldType) isText() bool {
+	_, ok := fieldTextBytes[t.name]
+	return ok || t.kind == fieldJson
+}
+
+//检查并转换一个值，整数为int64(超过int64的bigint unsigned为uint64)，浮点数为float64
+//datetime可以是时间戳或者时间字符串，统一转换成本地时间的 2006-01-02 15:04:05
+//空值为0、空字符串、时间戳0或者json的null
+func (t *fieldType) convert(name string, str string) (interface{}, error) {
+	switch t.kind {
+	case fieldInt:
+		return t.convertInt(name, str)
+	case fieldFloat:
+		return t.convertFloat(name, str)
+	case fieldDatetime:
+		return convertDatetime(name, str)
+	case fieldJson:
+		if len(str) <= 0 {
+			return "null", nil
+		}
+		if !json.Valid([]byte(str)) {
+			return nil, fmt.Errorf("字段 %s 不是json %s", name, str)
+		}
+		return str, nil
+	default:
+		if !utf8.ValidString(str) {
+			return nil, fmt.Errorf("字段 %s 不是有效的utf8", name)
+		}
+		if t.length > 0 && utf8.RuneCountInString(str) > t.length {
+			return nil, fmt.Errorf("字段 %s 超过长度%d %s", name, t.length, str)
+		}
+		if t.maxBytes > 0 && int64(len(str)) > t.maxBytes {
+			return nil, fmt.Errorf("字段 %s 超过长度%d字节", name, t.maxBytes)
+		}
+		return str, nil
+	}
+}
+
+func (t *fieldType) convertInt(name string, str string) (interface{}, error) {
+	if len(str) <= 0 {
+		return int64(0), nil
+	}
+	if t.unsigned {
+		u, err := strconv.ParseUint(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("字段 %s 不是无符号整数 %s", name, str)
+		}
+		if t.bits < 64 && u > 1<<t.bits-1 {
+			return nil, fmt.Errorf("字段 %s 超出范围 %s", name, str)
+		}
+		if u > math.MaxInt64 {
+			return u, nil
+		}
+		return int64(u), nil
+	}
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("字段 %s 不是整数 %s", name, str)
+	}
+	if t.bits < 64 && (i < -1<<(t.bits-1) || i > 1<<(t.bits-1)-1) {
+		return nil, fmt.Errorf("字段 %s 超出范围 %s", name, str)
+	}
+	return i, nil
+}
+
+func (t *fieldType) convertFloat(name string, str string) (interface{}, error) {
+	if len(str) <= 0 {
+		return float64(0), nil
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("字段 %s 不是数字 %s", name, str)
+	}
+	if t.unsigned && f < 0 {
+		return nil, fmt.Errorf("字段 %s 超出范围 %s", name, str)
+	}
+	if t.precision > 0 && math.Abs(f) >= math.Pow10(t.precision-t.scale) {
+		return nil, fmt.Errorf("字段 %s 超出范围 %s", name, str)
+	}
+	return f, nil
+}
+
+//lib/pq和go-sqlite3不支持最高位为1的uint64，超过int64的bigint unsigned写成十进制字符串
+func formatUint64Args(args []interface{}) []interface{} {
+	for i, arg := range args {
+		if u, ok := arg.(uint64); ok {
+			args[i] = strconv.FormatUint(u, 10)
+		}
+	}
+	return args
+}
+
+var datetimeLayouts = []string{datetimeLayout, "2006-01-02T15:04:05", "2006-01-02"}
+
+func convertDatetime(name string, str string) (interface{}, error) {
+	if len(str) <= 0 {
+		return time.Unix(0, 0).Format(datetimeLayout), nil
+	}
+	if sec, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(sec, 0).Format(datetimeLayout), nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.Local().Format(datetimeLayout), nil
+	}
+	for _, layout := range datetimeLayouts {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t.Format(datetimeLayout), nil
+		}
+	}
+	return nil, fmt.Errorf("字段 %s 不是时间 %s", name, str)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFieldType(t *testing.T) {
+	cases := []struct {
+		typ    string
+		expect *fieldType //nil为不支持的类型
+	}{
+		{"int(11)", &fieldType{name: "int", kind: fieldInt, bits: 32}},
+		{"BIGINT(20) UNSIGNED", &fieldType{name: "bigint", kind: fieldInt, bits: 64, unsigned: true}},
+		{" tinyint unsigned ", &fieldType{name: "tinyint", kind: fieldInt, bits: 8, unsigned: true}},
+		{"mediumint", &fieldType{name: "mediumint", kind: fieldInt, bits: 24}},
+		{"double unsigned", &fieldType{name: "double", kind: fieldFloat, unsigned: true}},
+		{"decimal", &fieldType{name: "decimal", kind: fieldFloat}},
+		{"decimal(12,2)", &fieldType{name: "decimal", kind: fieldFloat, precision: 12, scale: 2}},
+		{"decimal(10)", &fieldType{name: "decimal", kind: fieldFloat, precision: 10}},
+		{"decimal(65,30)", &fieldType{name: "decimal", kind: fieldFloat, precision: 65, scale: 30}},
+		{"decimal(66,2)", nil},
+		{"decimal(2,3)", nil},
+		{"decimal(0)", nil},
+		{"varchar(32)", &fieldType{name: "varchar", kind: fieldString, length: 32}},
+		{"char(8)", &fieldType{name: "char", kind: fieldString, length: 8}},
+		{"varchar", nil},
+		{"tinytext", &fieldType{name: "tinytext", kind: fieldString, maxBytes: 255}},
+		{"longtext", &fieldType{name: "longtext", kind: fieldString}},
+		{"datetime", &fieldType{name: "datetime", kind: fieldDatetime}},
+		{"json", &fieldType{name: "json", kind: fieldJson}},
+		{"blob", nil},
+		{"int unsigned zerofill", nil},
+	}
+	for _, c := range cases {
+		typ, err := parseFieldType(c.typ)
+		if c.expect == nil {
+			if err == nil {
+				t.Errorf("%s 应该不支持，解析成了 %+v", c.typ, typ)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s 解析失败 %v", c.typ, err)
+			continue
+		}
+		if !reflect.DeepEqual(typ, c.expect) {
+			t.Errorf("%s 解析成了 %+v，应该是 %+v", c.typ, typ, c.expect)
+		}
+	}
+}
+
+func TestFieldConvert(t *testing.T) {
+	localTime := func(year int, month time.Month, day, hour int) string {
+		return time.Date(year, month, day, hour, 0, 0, 0, time.Local).Format(datetimeLayout)
+	}
+	cases := []struct {
+		typ    string
+		str    string
+		expect interface{} //nil为检查失败
+	}{
+		{"tinyint", "127", int64(127)},
+		{"tinyint", "-128", int64(-128)},
+		{"tinyint", "128", nil},
+		{"tinyint", "-129", nil},
+		{"tinyint unsigned", "255", int64(255)},
+		{"tinyint unsigned", "256", nil},
+		{"tinyint unsigned", "-1", nil},
+		{"int", "2147483647", int64(2147483647)},
+		{"int", "2147483648", nil},
+		{"int", "", int64(0)},
+		{"int", "1.5", nil},
+		{"int", "abc", nil},
+		{"bigint", "9223372036854775807", int64(9223372036854775807)},
+		{"bigint", "-9223372036854775808", int64(-9223372036854775808)},
+		{"bigint", "9223372036854775808", nil},
+		{"bigint unsigned", "9223372036854775807", int64(9223372036854775807)},
+		{"bigint unsigned", "9223372036854775808", uint64(9223372036854775808)},
+		{"bigint unsigned", "18446744073709551615", uint64(18446744073709551615)},
+		{"bigint unsigned", "18446744073709551616", nil},
+		{"double", "1.5e3", float64(1500)},
+		{"double", "", float64(0)},
+		{"double", "NaN", nil},
+		{"double", "Inf", nil},
+		{"double unsigned", "-0.1", nil},
+		{"decimal(5,2)", "999.99", float64(999.99)},
+		{"decimal(5,2)", "-999.99", float64(-999.99)},
+		{"decimal(5,2)", "1000", nil},
+		{"decimal(5,2)", "0.001", float64(0.001)},
+		{"decimal(3)", "999", float64(999)},
+		{"decimal(3)", "1000", nil},
+		{"varchar(3)", "中文字", "中文字"},
+		{"varchar(3)", "中文字符", nil},
+		{"varchar(3)", "abc", "abc"},
+		{"varchar(3)", "\xff", nil},
+		{"char(2)", "", ""},
+		{"tinytext", strings.Repeat("a", 255), strings.Repeat("a", 255)},
+		{"tinytext", strings.Repeat("a", 256), nil},
+		{"tinytext", strings.Repeat("中", 86), nil},
+		{"longtext", strings.Repeat("a", 70000), strings.Repeat("a", 70000)},
+		{"datetime", "", time.Unix(0, 0).Format(datetimeLayout)},
+		{"datetime", "2021-01-15 08:00:00", localTime(2021, 1, 15, 8)},
+		{"datetime", "2021-01-15T08:00:00", localTime(2021, 1, 15, 8)},
+		{"datetime", "2021-01-15", localTime(2021, 1, 15, 0)},
+		{"datetime", "1610668800", time.Unix(1610668800, 0).Format(datetimeLayout)},
+		{"datetime", "2021-01-15T00:00:00Z", time.Date(2021, 1, 15, 0, 0, 0, 0, time.UTC).Local().Format(datetimeLayout)},
+		{"datetime", "2021-01-15T08:00:00+08:00", time.Date(2021, 1, 15, 0, 0, 0, 0, time.UTC).Local().Format(datetimeLayout)},
+		{"datetime", "2021/01/15", nil},
+		{"datetime", "2021-13-01", nil},
+		{"json", "", "null"},
+		{"json", `{"a":1}`, `{"a":1}`},
+		{"json", `[1,"b"]`, `[1,"b"]`},
+		{"json", `{a:1}`, nil},
+		{"json", `{"a":1`, nil},
+	}
+	for _, c := range cases {
+		typ, err := parseFieldType(c.typ)
+		if err != nil {
+			t.Fatalf("%s 解析失败 %v", c.typ, err)
+		}
+		v, err := typ.convert("f", c.str)
+		if c.expect == nil {
+			if err == nil {
+				t.Errorf("%s %q 应该检查失败，转换成了 %T %v", c.typ, c.str, v, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q 检查失败 %v", c.typ, c.str, err)
+			continue
+		}
+		if !reflect.DeepEqual(v, c.expect) {
+			t.Errorf("%s %q 转换成了 %T %v，应该是 %T %v", c.typ, c.str, v, v, c.expect, c.expect)
+		}
+	}
+}
+
+func TestFormatUint64Args(t *testing.T) {
+	args := formatUint64Args([]interface{}{int64(1), uint64(18446744073709551615), "a", nil})
+	expect := []interface{}{int64(1), "18446744073709551615", "a", nil}
+	if !reflect.DeepEqual(args, expect) {
+		t.Errorf("转换成了 %#v，应该是 %#v", args, expect)
+	}
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//每种日志一个topic，消息都被确认后才算写入成功，同步进度在这之后提交，保证至少一次
+type kafkaSink struct {
+	producer sarama.SyncProducer
+	encoding string
+}
+
+//json格式的一条日志，和http接口接收的格式相同
+type kafkaRecord struct {
+	Name    string                 `json:"name"`
+	Version int64                  `json:"version"`
+	Logtime int64                  `json:"logtime"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+func newKafkaSink() (Sink, error) {
+	encoding := config.Ini.Kafka.Encoding
+	if len(encoding) <= 0 {
+		encoding = "json"
+	}
+	if encoding != "json" && encoding != "avro" {
+		return nil, fmt.Errorf("不支持的kafka编码 %s", encoding)
+	}
+	brokers := make([]string, 0)
+	for _, broker := range strings.Split(config.Ini.Kafka.Brokers, ",") {
+		if broker = strings.TrimSpace(broker); len(broker) > 0 {
+			brokers = append(brokers, broker)
+		}
+	}
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "tlogsync"
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Retry.Max = 3
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("连接kafka成功 %s, 编码=%s\n", config.Ini.Kafka.Brokers, encoding)
+	return newKafkaProducerSink(producer, encoding), nil
+}
+
+//producer可以换成sarama/mocks里的SyncProducer，测试时不需要kafka
+func newKafkaProducerSink(producer sarama.SyncProducer, encoding string) *kafkaSink {
+	return &kafkaSink{producer: producer, encoding: encoding}
+}
+
+func (s *kafkaSink) Name() string {
+	return "kafka"
+}
+
+//topic由broker自动创建，不需要建表，avro的话打印当月的schema
+func (s *kafkaSink) CreateTable(tlogModel *TlogModel, month int) error {
+	if s.encoding == "avro" && month == logtime2Month(time.Now().Unix()) {
+		log.Printf("avro schema %s %s\n", s.topic(tlogModel), tlogModel.avroSchema())
+	}
+	return nil
+}
+
+func (s *kafkaSink) AddColumn(tlogModel *TlogModel, month int) error {
+	return nil
+}
+
+func (s *kafkaSink) AddIndex(tlogModel *TlogModel, month int) error {
+	return nil
+}
+
+func (s *kafkaSink) Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error {
+	now := time.Now().Unix()
+	topic := s.topic(tlogModel)
+	fingerprint := avroFingerprint(tlogModel.avroSchema())
+	msgs := make([]*sarama.ProducerMessage, 0, len(rows))
+	for i, row := range rows {
+		values, err := tlogModel.formInsertArgs(row, sources[i], now)
+		if err != nil {
+			log.Printf("db.kafkaSink.Insert err %+v\n", err)
+			return err
+		}
+		var bs []byte
+		if s.encoding == "avro" {
+			bs, err = tlogModel.avroEncode(fingerprint, values)
+		} else {
+			bs, err = kafkaJson(tlogModel, values)
+		}
+		if err != nil {
+			log.Printf("db.kafkaSink.Insert err %+v\n", err)
+			return err
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: topic,
+			Key:   sarama.StringEncoder(kafkaKey(tlogModel, values)),
+			Value: sarama.ByteEncoder(bs),
+		})
+	}
+	if err := s.producer.SendMessages(msgs); err != nil {
+		if errs, ok := err.(sarama.ProducerErrors); ok && len(errs) > 0 {
+			log.Printf("db.kafkaSink.Insert err %+v, %+v\n", err, errs[0].Err)
+		} else {
+			log.Printf("db.kafkaSink.Insert err %+v\n", err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *kafkaSink) topic(tlogModel *TlogModel) string {
+	return config.Ini.Kafka.TopicPrefix + strings.ToLower(tlogModel.Name)
+}
+
+//日志名加上userid，同一个用户的日志在同一个分区里保持顺序
+func kafkaKey(tlogModel *TlogModel, values []interface{}) string {
+	for i, field := range tlogModel.FieldArr {
+		if field.Name == "userid" {
+			return fmt.Sprintf("%s:%v", tlogModel.Name, values[i])
+		}
+	}
+	return tlogModel.Name
+}
+
+func kafkaJson(tlogModel *TlogModel, values []interface{}) ([]byte, error) {
+	record := kafkaRecord{
+		Name:   tlogModel.Name,
+		Fields: make(map[string]interface{}),
+	}
+	for i, field := range tlogModel.FieldArr {
+		switch field.Name {
+		case "version":
+			record.Version = values[i].(int64)
+		case "logtime":
+			record.Logtime = values[i].(int64)
+		case "createtime", "updatetime":
+		default:
+			if str, ok := values[i].(string); ok && field.kind() == fieldJson {
+				//json字段直接嵌在消息里
+				record.Fields[field.Name] = json.RawMessage(str)
+			} else {
+				record.Fields[field.Name] = values[i]
+			}
+		}
+	}
+	return json.Marshal(record)
+}
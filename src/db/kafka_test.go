@@ -0,0 +1,211 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+const kafkaTestXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="Login" version="2" comment="登录">
+        <field name="gameid" type="int(11)"          comment="游戏id"/>
+        <field name="userid" type="bigint unsigned"  comment="用户id"/>
+        <field name="ip"     type="varchar(32)"      nullable="true" comment="ip"/>
+        <field name="extra"  type="json"             comment="扩展"/>
+    </tlog>
+    <tlog name="pay" version="1" comment="支付">
+        <field name="gameid" type="int(11)"          comment="游戏id"/>
+        <field name="amount" type="double"           comment="金额"/>
+    </tlog>
+</xml>
+`
+
+//记录发送的消息，检查topic和key，发送交给mocks
+type recordProducer struct {
+	*mocks.SyncProducer
+	msgs []*sarama.ProducerMessage
+}
+
+func (p *recordProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.msgs = append(p.msgs, msgs...)
+	return p.SyncProducer.SendMessages(msgs)
+}
+
+func loadKafkaTestModels(t *testing.T) (*TlogModel, *TlogModel) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tlog.xml")
+	if err := ioutil.WriteFile(path, []byte(kafkaTestXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadModelXml(path); err != nil {
+		t.Fatal(err)
+	}
+	config.Ini.Kafka.TopicPrefix = "tlog_"
+	return GetTlogModel("Loginv2"), GetTlogModel("payv1")
+}
+
+func newTestKafkaSink(t *testing.T, encoding string) (*kafkaSink, *recordProducer) {
+	producer := &recordProducer{SyncProducer: mocks.NewSyncProducer(t, nil)}
+	return newKafkaProducerSink(producer, encoding), producer
+}
+
+//每种日志一个topic，有userid的话key为 日志名:userid
+func TestKafkaTopicAndKey(t *testing.T) {
+	login, pay := loadKafkaTestModels(t)
+	sink, producer := newTestKafkaSink(t, "json")
+	defer producer.Close()
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	rows := [][]string{
+		{"Login", "2", "1600000000", "1", "10001", "127.0.0.1", "{}"},
+		{"Login", "2", "1600000000", "1", "18446744073709551615", "", ""},
+	}
+	if err := sink.Insert(login, rows, []string{"", ""}, 1600000000); err != nil {
+		t.Fatal(err)
+	}
+	producer.ExpectSendMessageAndSucceed()
+	if err := sink.Insert(pay, [][]string{{"pay", "1", "1600000000", "1", "6.5"}}, []string{""}, 1600000000); err != nil {
+		t.Fatal(err)
+	}
+	expects := []struct {
+		topic string
+		key   string
+	}{
+		{"tlog_login", "Login:10001"},
+		{"tlog_login", "Login:18446744073709551615"},
+		{"tlog_pay", "pay"},
+	}
+	if len(producer.msgs) != len(expects) {
+		t.Fatalf("发送了%d条消息", len(producer.msgs))
+	}
+	for i, expect := range expects {
+		msg := producer.msgs[i]
+		key, _ := msg.Key.Encode()
+		if msg.Topic != expect.topic || string(key) != expect.key {
+			t.Errorf("第%d条消息 topic=%s key=%s，应该是 %s %s", i, msg.Topic, key, expect.topic, expect.key)
+		}
+	}
+}
+
+//json字段直接嵌在消息里，NULL为null，超过int64的bigint unsigned保持原值
+func TestKafkaJson(t *testing.T) {
+	login, _ := loadKafkaTestModels(t)
+	sink, producer := newTestKafkaSink(t, "json")
+	defer producer.Close()
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		expect := `{"name":"Login","version":2,"logtime":1600000000,"fields":{"extra":{"a":1},"gameid":1,"ip":null,"userid":18446744073709551615}}`
+		if string(val) != expect {
+			return fmt.Errorf("json %s，应该是 %s", val, expect)
+		}
+		return nil
+	})
+	rows := [][]string{{"Login", "2", "1600000000", "1", "18446744073709551615", "", `{"a":1}`}}
+	if err := sink.Insert(login, rows, []string{""}, 1600000000); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//按schema解码avro，检查每个字段
+func TestKafkaAvro(t *testing.T) {
+	login, _ := loadKafkaTestModels(t)
+	schema := login.avroSchema()
+	if !strings.Contains(schema, `{"name":"userid","type":"string"}`) || !strings.Contains(schema, `{"name":"ip","type":["null","string"]}`) {
+		t.Fatalf("avro schema %s", schema)
+	}
+	sink, producer := newTestKafkaSink(t, "avro")
+	defer producer.Close()
+	values := make([][]interface{}, 0)
+	for i := 0; i < 2; i++ {
+		producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+			v, err := decodeTestAvro(login, val)
+			values = append(values, v)
+			return err
+		})
+	}
+	rows := [][]string{
+		{"Login", "2", "1600000000", "7", "18446744073709551615", "", "[1]"},
+		{"Login", "2", "1600000000", "-3", "42", "127.0.0.1", ""},
+	}
+	if err := sink.Insert(login, rows, []string{"", ""}, 1600000000); err != nil {
+		t.Fatal(err)
+	}
+	//createtime和updatetime是写入时间，不比较
+	expects := []string{
+		"[2 1600000000 7 18446744073709551615 <nil> [1]]",
+		"[2 1600000000 -3 42 127.0.0.1 null]",
+	}
+	for i, expect := range expects {
+		v := append(values[i][:2:2], values[i][4:]...)
+		if fmt.Sprint(v) != expect {
+			t.Errorf("第%d行 %v，应该是 %s", i, v, expect)
+		}
+	}
+}
+
+//单对象编码: C3 01 + 8字节指纹 + 按字段顺序的值
+func decodeTestAvro(tlog *TlogModel, val []byte) ([]interface{}, error) {
+	if !bytes.HasPrefix(val, avroMagic) {
+		return nil, fmt.Errorf("avro magic错误 %x", val[:2])
+	}
+	if fp := binary.LittleEndian.Uint64(val[2:10]); fp != avroFingerprint(tlog.avroSchema()) {
+		return nil, fmt.Errorf("avro指纹错误 %x", fp)
+	}
+	buff := bytes.NewReader(val[10:])
+	values := make([]interface{}, 0, len(tlog.FieldArr))
+	for _, field := range tlog.FieldArr {
+		typ := avroType(field)
+		if union, ok := typ.([]string); ok {
+			branch, err := binary.ReadVarint(buff)
+			if err != nil {
+				return nil, err
+			}
+			if branch == 0 {
+				values = append(values, nil)
+				continue
+			}
+			typ = union[branch]
+		}
+		switch typ {
+		case "long":
+			v, err := binary.ReadVarint(buff)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		case "double":
+			var v float64
+			if err := binary.Read(buff, binary.LittleEndian, &v); err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		default:
+			n, err := binary.ReadVarint(buff)
+			if err != nil {
+				return nil, err
+			}
+			bs := make([]byte, n)
+			if _, err := buff.Read(bs); err != nil {
+				return nil, err
+			}
+			values = append(values, string(bs))
+		}
+	}
+	if buff.Len() > 0 {
+		return nil, fmt.Errorf("avro多出%d字节", buff.Len())
+	}
+	return values, nil
+}
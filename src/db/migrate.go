@@ -0,0 +1,206 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+//比较xml和数据库的表结构，生成让表和xml一致的语句
+type migrator interface {
+	planMigration(tlogModel *TlogModel, versions []*TlogModel) ([]*migrationTable, error)
+	execMigration(sql string) error
+}
+
+//一张表需要执行的语句，按顺序执行
+type migrationTable struct {
+	tableName string
+	sqlArr    []string
+}
+
+//对比每个日志所有已经存在的表，打印需要执行的语句，apply为true时执行，遇到错误停止
+//列的类型和是否可以为NULL按最新的版本，所有版本都没有的列才删除，旧版本的日志还可以写入
+//所有版本都没有的索引只删除i_开头的和u_dedupkey，手动加的索引保留
+func Migrate(apply bool) error {
+	modelLock.RLock()
+	versions := make(map[string][]*TlogModel)
+	for _, tlogModel := range tlogArr {
+		versions[tlogModel.Name] = append(versions[tlogModel.Name], tlogModel)
+	}
+	modelLock.RUnlock()
+	count, compared := 0, 0
+	for _, sink := range sinks {
+		m, ok := sink.(migrator)
+		if !ok {
+			log.Println("不支持对比表结构", sink.Name())
+			continue
+		}
+		compared++
+		for _, tlogModel := range latestModels() {
+			if !tlogModel.HasSink(sink.Name()) {
+				continue
+			}
+			tables, err := m.planMigration(tlogModel, versions[tlogModel.Name])
+			if err != nil {
+				return err
+			}
+			for _, table := range tables {
+				log.Printf("%s %s 需要执行%d个语句\n", sink.Name(), table.tableName, len(table.sqlArr))
+				for _, sql := range table.sqlArr {
+					fmt.Println(sql + ";")
+					count++
+				}
+			}
+			if !apply {
+				continue
+			}
+			for _, table := range tables {
+				for _, sql := range table.sqlArr {
+					log.Println("执行", sql)
+					if err := m.execMigration(sql); err != nil {
+						return fmt.Errorf("%s %s 执行失败 %s", sink.Name(), table.tableName, err.Error())
+					}
+				}
+			}
+		}
+	}
+	if compared <= 0 {
+		return nil
+	}
+	if count <= 0 {
+		log.Println("表结构和xml一致")
+	} else if !apply {
+		log.Printf("需要执行%d个语句，确认后加上 -confirm 执行\n", count)
+	}
+	return nil
+}
+
+//这个日志所有已经存在的表，按月分表的话是每个月的表
+func (s *mysqlSink) shardTables(tlogModel *TlogModel) ([]string, error) {
+	name := strings.ToLower(tlogModel.Name)
+	tables := make([]string, 0)
+	if err := s.db.Select(&tables, "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name LIKE ? ORDER BY table_name", name+"%"); err != nil {
+		return nil, err
+	}
+	shardRegexp := regexp.MustCompile("^" + regexp.QuoteMeta(name) + `(_\d{6})?$`)
+	if tlogModel.Sharding != "month" {
+		shardRegexp = regexp.MustCompile("^" + regexp.QuoteMeta(name) + "$")
+	}
+	shards := make([]string, 0)
+	for _, table := range tables {
+		if shardRegexp.MatchString(table) {
+			shards = append(shards, table)
+		}
+	}
+	return shards, nil
+}
+
+func (s *mysqlSink) planMigration(tlogModel *TlogModel, versions []*TlogModel) ([]*migrationTable, error) {
+	tables, err := s.shardTables(tlogModel)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*migrationTable, 0)
+	for _, tableName := range tables {
+		schema, err := s.getTableSchema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		indexSchema, err := s.getTableIndexSchema(tableName)
+		if err != nil {
+			return nil, err
+		}
+		plan := planMysqlTable(tableName, tlogModel, versions, schema, indexSchema)
+		if len(plan.sqlArr) > 0 {
+			plans = append(plans, plan)
+		}
+	}
+	return plans, nil
+}
+
+func (s *mysqlSink) execMigration(sql string) error {
+	_, err := s.db.Exec(sql)
+	return err
+}
+
+//先删除索引，再增加、修改、删除列，最后增加或者重建索引
+func planMysqlTable(tableName string, tlogModel *TlogModel, versions []*TlogModel, schema *tableSchema, indexSchema *tableIndexSchema) *migrationTable {
+	plan := &migrationTable{
+		tableName: tableName,
+		sqlArr:    make([]string, 0),
+	}
+	columns := make(map[string]bool)
+	indexes := make(map[string]bool)
+	for _, version := range versions {
+		for _, field := range version.FieldArr {
+			columns[field.Name] = true
+		}
+		for _, index := range version.indexes {
+			indexes[index.Name] = true
+		}
+	}
+	dropped := make(map[string]bool)
+	for _, index := range indexSchema.indexArr {
+		if index.KeyName == "PRIMARY" || indexes[index.KeyName] || dropped[index.KeyName] {
+			continue
+		}
+		dropped[index.KeyName] = true
+		if !toolIndexName(index.KeyName) {
+			log.Printf("%s 的索引 %s 不在xml中，不是按xml创建的，不删除\n", tableName, index.KeyName)
+			continue
+		}
+		plan.sqlArr = append(plan.sqlArr, fmt.Sprintf("ALTER TABLE %s DROP INDEX `%s`", tableName, index.KeyName))
+	}
+	for _, field := range tlogModel.FieldArr {
+		column, ok := schema.fieldDict[field.Name]
+		if !ok {
+			plan.sqlArr = append(plan.sqlArr, field.formAddColumnSql(tableName))
+		} else if !field.sameColumn(column) {
+			plan.sqlArr = append(plan.sqlArr, field.formModifyColumnSql(tableName))
+		}
+	}
+	for _, column := range schema.fieldArr {
+		if column.Field == "id" || columns[column.Field] {
+			continue
+		}
+		plan.sqlArr = append(plan.sqlArr, fmt.Sprintf("ALTER TABLE %s DROP COLUMN `%s`", tableName, column.Field))
+	}
+	for _, index := range tlogModel.indexes {
+		if _, ok := indexSchema.indexDict[index.Name]; !ok {
+			plan.sqlArr = append(plan.sqlArr, index.formAddIndexSql(tableName))
+		} else if !indexSchema.same(index) {
+			plan.sqlArr = append(plan.sqlArr, index.formRebuildIndexSql(tableName))
+		}
+	}
+	return plan
+}
+
+//字段上的index和去重的索引，以及<index>中按约定以i_开头的名字，其它的可能是手动加的索引
+func toolIndexName(name string) bool {
+	return strings.HasPrefix(name, "i_") || name == dedupIndex
+}
+
+var mysqlIntWidthRegexp = regexp.MustCompile(`^(tinyint|smallint|mediumint|int|bigint)\(\d+\)`)
+
+//desc里的类型和xml里的类型统一格式后比较，整数的显示宽度不影响类型，mysql 8.0不再显示
+func mysqlColumnType(typ string) string {
+	typ = strings.ToLower(strings.Join(strings.Fields(typ), " "))
+	typ = strings.Replace(typ, "integer", "int", 1)
+	if typ == "decimal" || strings.HasPrefix(typ, "decimal ") {
+		typ = strings.Replace(typ, "decimal", "decimal(10,0)", 1)
+	}
+	return mysqlIntWidthRegexp.ReplaceAllString(typ, "$1")
+}
+
+//类型和是否可以为NULL和xml一致
+func (f *TlogField) sameColumn(column *fieldSchema) bool {
+	typ := f.Type
+	if f.Unsigned && !strings.Contains(strings.ToLower(f.Type), "unsigned") {
+		typ = typ + " unsigned"
+	}
+	if mysqlColumnType(typ) != mysqlColumnType(column.Type) {
+		return false
+	}
+	return f.Nullable == (column.Null == "YES")
+}
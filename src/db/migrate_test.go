@@ -0,0 +1,158 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const migrateTestXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="migratetest" version="1" comment="迁移">
+        <field name="gameid" type="int(11)"     index="true" comment="游戏id"/>
+        <field name="userid" type="bigint"      comment="用户id"/>
+        <field name="oldcol" type="varchar(10)" comment="旧版本的字段"/>
+        <index name="u_user" columns="userid" unique="true"/>
+    </tlog>
+    <tlog name="migratetest" version="2" comment="迁移">
+        <field name="gameid" type="int(11)"             comment="游戏id"/>
+        <field name="userid" type="bigint(20) unsigned" comment="用户id"/>
+        <field name="ip"     type="varchar(32)"         nullable="true" comment="ip"/>
+        <index name="i_user_ip" columns="userid,ip"/>
+    </tlog>
+</xml>
+`
+
+func TestPlanMysqlTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tlog.xml")
+	if err := ioutil.WriteFile(path, []byte(migrateTestXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadModelXml(path); err != nil {
+		t.Fatal(err)
+	}
+	v1, v2 := GetTlogModel("migratetestv1"), GetTlogModel("migratetestv2")
+	versions := []*TlogModel{v1, v2}
+	//表按第一个版本建的，后来手动加了legacy列和idx_dba索引
+	fieldArr := []*fieldSchema{{Field: "id", Type: "bigint(20)", Null: "NO"}}
+	for _, field := range v1.FieldArr {
+		fieldArr = append(fieldArr, &fieldSchema{Field: field.Name, Type: field.Type, Null: "NO"})
+	}
+	fieldArr = append(fieldArr, &fieldSchema{Field: "legacy", Type: "int(11)", Null: "YES"})
+	schema := &tableSchema{fieldArr: fieldArr, fieldDict: make(map[string]*fieldSchema)}
+	for _, field := range fieldArr {
+		schema.fieldDict[field.Field] = field
+	}
+	indexArr := []*indexSchema{
+		{KeyName: "PRIMARY", Seq_in_index: 1, ColumnName: "id"},
+		{KeyName: "i_logtime", Non_unique: 1, Seq_in_index: 1, ColumnName: "logtime"},
+		{KeyName: "i_gameid", Non_unique: 1, Seq_in_index: 1, ColumnName: "gameid"},
+		{KeyName: "u_user", Seq_in_index: 1, ColumnName: "userid"},
+		{KeyName: "i_user_ip", Non_unique: 1, Seq_in_index: 1, ColumnName: "userid"},
+		{KeyName: "i_removed", Non_unique: 1, Seq_in_index: 1, ColumnName: "oldcol"},
+		{KeyName: "i_removed", Non_unique: 1, Seq_in_index: 2, ColumnName: "gameid"},
+		{KeyName: "u_dedupkey", Seq_in_index: 1, ColumnName: "oldcol"},
+		{KeyName: "idx_dba", Non_unique: 1, Seq_in_index: 1, ColumnName: "legacy"},
+	}
+	indexes := &tableIndexSchema{indexArr: indexArr, indexDict: make(map[string]*indexSchema)}
+	for _, index := range indexArr {
+		indexes.indexDict[index.KeyName] = index
+	}
+	var userIp *TlogIndex
+	for _, index := range v2.indexes {
+		if index.Name == "i_user_ip" {
+			userIp = index
+		}
+	}
+	plan := planMysqlTable("migratetest", v2, versions, schema, indexes)
+	expect := []string{
+		"ALTER TABLE migratetest DROP INDEX `i_removed`",
+		"ALTER TABLE migratetest DROP INDEX `u_dedupkey`",
+		v2.fieldDict["userid"].formModifyColumnSql("migratetest"),
+		v2.fieldDict["ip"].formAddColumnSql("migratetest"),
+		"ALTER TABLE migratetest DROP COLUMN `legacy`",
+		userIp.formRebuildIndexSql("migratetest"),
+	}
+	if !reflect.DeepEqual(plan.sqlArr, expect) {
+		t.Errorf("生成的语句\n%v\n应该是\n%v", plan.sqlArr, expect)
+	}
+	//和最新版本一致的表不需要执行语句
+	fieldArr = []*fieldSchema{{Field: "id", Type: "bigint(20)", Null: "NO"}}
+	for _, field := range v2.FieldArr {
+		null := "NO"
+		if field.Nullable {
+			null = "YES"
+		}
+		fieldArr = append(fieldArr, &fieldSchema{Field: field.Name, Type: field.Type, Null: null})
+	}
+	schema = &tableSchema{fieldArr: fieldArr, fieldDict: make(map[string]*fieldSchema)}
+	for _, field := range fieldArr {
+		schema.fieldDict[field.Field] = field
+	}
+	indexArr = []*indexSchema{
+		{KeyName: "PRIMARY", Seq_in_index: 1, ColumnName: "id"},
+		{KeyName: "i_logtime", Non_unique: 1, Seq_in_index: 1, ColumnName: "logtime"},
+		{KeyName: "i_user_ip", Non_unique: 1, Seq_in_index: 1, ColumnName: "userid"},
+		{KeyName: "i_user_ip", Non_unique: 1, Seq_in_index: 2, ColumnName: "ip"},
+	}
+	indexes = &tableIndexSchema{indexArr: indexArr, indexDict: make(map[string]*indexSchema)}
+	for _, index := range indexArr {
+		indexes.indexDict[index.KeyName] = index
+	}
+	if plan := planMysqlTable("migratetest", v2, versions, schema, indexes); len(plan.sqlArr) > 0 {
+		t.Errorf("表和xml一致，生成了语句 %v", plan.sqlArr)
+	}
+}
+
+func TestMysqlColumnType(t *testing.T) {
+	cases := []struct {
+		typ    string
+		expect string
+	}{
+		{"int(11)", "int"},
+		{"INT(10) UNSIGNED", "int unsigned"},
+		{"bigint(20)  unsigned", "bigint unsigned"},
+		{"integer", "int"},
+		{"tinyint(1)", "tinyint"},
+		{"decimal", "decimal(10,0)"},
+		{"decimal unsigned", "decimal(10,0) unsigned"},
+		{"decimal(12,2)", "decimal(12,2)"},
+		{"varchar(32)", "varchar(32)"},
+		{"datetime", "datetime"},
+	}
+	for _, c := range cases {
+		if typ := mysqlColumnType(c.typ); typ != c.expect {
+			t.Errorf("%s 转换成了 %s，应该是 %s", c.typ, typ, c.expect)
+		}
+	}
+}
+
+func TestSameColumn(t *testing.T) {
+	cases := []struct {
+		field  *TlogField
+		column *fieldSchema
+		same   bool
+	}{
+		{&TlogField{Type: "int(11)"}, &fieldSchema{Type: "int", Null: "NO"}, true},
+		{&TlogField{Type: "int(11)"}, &fieldSchema{Type: "int(11)", Null: "YES"}, false},
+		{&TlogField{Type: "int(11)", Nullable: true}, &fieldSchema{Type: "int(11)", Null: "YES"}, true},
+		{&TlogField{Type: "int", Unsigned: true}, &fieldSchema{Type: "int(10) unsigned", Null: "NO"}, true},
+		{&TlogField{Type: "int unsigned", Unsigned: true}, &fieldSchema{Type: "int(10) unsigned", Null: "NO"}, true},
+		{&TlogField{Type: "int"}, &fieldSchema{Type: "int(10) unsigned", Null: "NO"}, false},
+		{&TlogField{Type: "bigint"}, &fieldSchema{Type: "int(11)", Null: "NO"}, false},
+		{&TlogField{Type: "decimal"}, &fieldSchema{Type: "decimal(10,0)", Null: "NO"}, true},
+		{&TlogField{Type: "varchar(32)"}, &fieldSchema{Type: "varchar(64)", Null: "NO"}, false},
+	}
+	for i, c := range cases {
+		if c.field.sameColumn(c.column) != c.same {
+			t.Errorf("第%d个 %s 和 %s 应该是 %v", i, c.field.Type, c.column.Type, c.same)
+		}
+	}
+}
@@ -6,44 +6,81 @@ import (
 	"io/ioutil"
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/shark/minigame-tlogsync/config"
 )
 
+//重新加载xml时整体替换，已经在缓存里的日志继续使用旧的模型
+var modelLock sync.RWMutex
 var tlogDict map[string]*TlogModel
 var tlogVerDict map[string]*TlogModel
 var tlogArr []*TlogModel
 
+//串行重新加载
+var reloadLock sync.Mutex
+
 type TlogModel struct {
 	fieldSql  string
+	indexSql  string
 	fieldDict map[string]*TlogField
+	sinkDict  map[string]bool
+	indexes   []*TlogIndex //字段上的index和<index>
+	dedupArr  []int        //按字段去重时字段在FieldArr中的位置
 	VerName   string
 	Version   int          `xml:"version,attr"`
 	FieldArr  []*TlogField `xml:"field"`
+	IndexArr  []*TlogIndex `xml:"index"`
 	Name      string       `xml:"name,attr"`
 	Comment   string       `xml:"comment,attr"`
 	Sharding  string       `xml:"sharding,attr"`
+	Sink      string       `xml:"sink,attr"`  //写入目标，多个用逗号分隔，为空写入所有目标
+	Dedup     string       `xml:"dedup,attr"` //去重，source:来源文件名和行号，或者多个字段用逗号分隔
 }
 
+//去重键保存在最后一列，和logtime一起建唯一索引，按月分区的postgres表的唯一索引要包含logtime
+const (
+	dedupSource = "source"
+	dedupColumn = "dedupkey"
+	dedupIndex  = "u_dedupkey"
+)
+
 type TlogField struct {
-	Name    string `xml:"name,attr"`
-	Type    string `xml:"type,attr"`
-	Comment string `xml:"comment,attr"`
-	Index   bool   `xml:"index,attr"`
+	typ          *fieldType
+	defaultValue interface{} //default按类型转换后的值
+	Name         string      `xml:"name,attr"`
+	Type         string      `xml:"type,attr"`
+	Comment      string      `xml:"comment,attr"`
+	Index        bool        `xml:"index,attr"`
+	Nullable     bool        `xml:"nullable,attr"` //空值写入NULL
+	Default      *string     `xml:"default,attr"`  //空值写入默认值，优先于NULL
+	Unsigned     bool        `xml:"unsigned,attr"` //和类型里写unsigned相同
+}
+
+//多列索引或者唯一索引，字段上的index为 i_字段名 的单列索引
+type TlogIndex struct {
+	columnArr []string
+	Name      string `xml:"name,attr"`
+	Columns   string `xml:"columns,attr"` //多个用逗号分隔，按顺序
+	Unique    bool   `xml:"unique,attr"`
 }
 
 type tlogXml struct {
 	TlogArr []*TlogModel `xml:"tlog"`
 }
 
-func loadModelXml(filename string) error {
+//加载xml，返回新增或者字段有变化的日志
+func loadModelXml(filename string) ([]*TlogModel, error) {
 	bs, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var x tlogXml
 	if err := xml.Unmarshal(bs, &x); err != nil {
-		return err
+		return nil, err
+	}
+	if err := x.validate(); err != nil {
+		return nil, err
 	}
 
 	for _, tlogModel := range x.TlogArr {
@@ -65,36 +102,250 @@ func loadModelXml(filename string) error {
 			Type:    "int",
 			Comment: "更新时间",
 		}}, tlogModel.FieldArr[0:]...)
+		if len(tlogModel.Dedup) > 0 {
+			tlogModel.FieldArr = append(tlogModel.FieldArr, &TlogField{
+				Name:     dedupColumn,
+				Type:     "char(40)",
+				Comment:  "去重",
+				Nullable: true,
+			})
+		}
 		tlogModel.fieldDict = make(map[string]*TlogField)
 		for _, field := range tlogModel.FieldArr {
 			tlogModel.fieldDict[field.Name] = field
+			if err := field.parse(); err != nil {
+				return nil, err
+			}
 		}
 		tlogModel.fieldSql = tlogModel.formFieldSql()
+		tlogModel.indexes = make([]*TlogIndex, 0)
+		for _, field := range tlogModel.FieldArr {
+			if field.Index {
+				tlogModel.indexes = append(tlogModel.indexes, &TlogIndex{
+					columnArr: []string{field.Name},
+					Name:      "i_" + field.Name,
+					Columns:   field.Name,
+				})
+			}
+		}
+		for _, index := range tlogModel.IndexArr {
+			index.columnArr = splitColumns(index.Columns)
+			tlogModel.indexes = append(tlogModel.indexes, index)
+		}
+		tlogModel.dedupArr = make([]int, 0)
+		if len(tlogModel.Dedup) > 0 {
+			tlogModel.indexes = append(tlogModel.indexes, &TlogIndex{
+				columnArr: []string{dedupColumn, "logtime"},
+				Name:      dedupIndex,
+				Columns:   dedupColumn + ",logtime",
+				Unique:    true,
+			})
+			if tlogModel.Dedup != dedupSource {
+				for _, name := range splitColumns(tlogModel.Dedup) {
+					for i, field := range tlogModel.FieldArr {
+						if field.Name == name {
+							tlogModel.dedupArr = append(tlogModel.dedupArr, i)
+						}
+					}
+				}
+			}
+		}
+		tlogModel.indexSql = tlogModel.formIndexSql()
+		tlogModel.sinkDict = make(map[string]bool)
+		for _, name := range strings.Split(tlogModel.Sink, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				tlogModel.sinkDict[name] = true
+			}
+		}
 		tlogModel.VerName = fmt.Sprintf("%sv%d", tlogModel.Name, tlogModel.Version)
 		if config.Ini.Basic.Debug {
 			log.Println(tlogModel.formCreateTableSQL())
-			for _, field := range tlogModel.FieldArr {
-				if field.Index {
-					log.Println(field.formAddIndexSql(tlogModel.Name))
-				}
+			for _, index := range tlogModel.indexes {
+				log.Println(index.formAddIndexSql(tlogModel.Name))
 			}
 		}
 	}
-	tlogDict = make(map[string]*TlogModel)
-	tlogVerDict = make(map[string]*TlogModel)
-	tlogArr = make([]*TlogModel, 0)
+	newTlogDict := make(map[string]*TlogModel)
+	newTlogVerDict := make(map[string]*TlogModel)
+	newTlogArr := make([]*TlogModel, 0)
 	for _, tlogModel := range x.TlogArr {
-		tlogVerDict[tlogModel.VerName] = tlogModel
-		if lastTlogModel, ok := tlogDict[tlogModel.Name]; !ok || (ok && tlogModel.Version > lastTlogModel.Version) {
-			tlogDict[tlogModel.Name] = tlogModel
+		newTlogVerDict[tlogModel.VerName] = tlogModel
+		if lastTlogModel, ok := newTlogDict[tlogModel.Name]; !ok || (ok && tlogModel.Version > lastTlogModel.Version) {
+			newTlogDict[tlogModel.Name] = tlogModel
 		}
-		tlogArr = append(tlogArr, tlogModel)
+		newTlogArr = append(newTlogArr, tlogModel)
 	}
 	//log.Printf("afasf %+v\n", tlogDict["gatestat"])
 	//log.Printf("afasf %+v\n", tlogVerDict["gatestatv2"].fieldSql)
+	modelLock.Lock()
+	oldTlogDict := tlogDict
+	tlogDict = newTlogDict
+	tlogVerDict = newTlogVerDict
+	tlogArr = newTlogArr
+	modelLock.Unlock()
+	changed := make([]*TlogModel, 0)
+	for name, tlogModel := range newTlogDict {
+		if lastTlogModel, ok := oldTlogDict[name]; !ok || lastTlogModel.fieldSql != tlogModel.fieldSql || lastTlogModel.indexSql != tlogModel.indexSql || lastTlogModel.Sink != tlogModel.Sink {
+			changed = append(changed, tlogModel)
+		}
+	}
+	return changed, nil
+}
+
+//检查xml是否正确，有错误的话不替换
+func (x *tlogXml) validate() error {
+	verNames := make(map[string]bool)
+	for _, tlogModel := range x.TlogArr {
+		if len(tlogModel.Name) <= 0 {
+			return fmt.Errorf("tlog缺少name")
+		}
+		if tlogModel.Version <= 0 {
+			return fmt.Errorf("%s version错误", tlogModel.Name)
+		}
+		if tlogModel.Sharding != "" && tlogModel.Sharding != "month" {
+			return fmt.Errorf("%s sharding错误 %s", tlogModel.Name, tlogModel.Sharding)
+		}
+		for _, name := range strings.Split(tlogModel.Sink, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 && !sinkExists(name) {
+				return fmt.Errorf("%s sink没有配置 %s", tlogModel.Name, name)
+			}
+		}
+		verName := fmt.Sprintf("%sv%d", tlogModel.Name, tlogModel.Version)
+		if verNames[verName] {
+			return fmt.Errorf("%s version重复 %d", tlogModel.Name, tlogModel.Version)
+		}
+		verNames[verName] = true
+		fieldNames := map[string]bool{"id": true, "version": true, "logtime": true, "createtime": true, "updatetime": true}
+		if len(tlogModel.Dedup) > 0 {
+			fieldNames[dedupColumn] = true
+		}
+		for _, field := range tlogModel.FieldArr {
+			if len(field.Name) <= 0 || len(field.Type) <= 0 {
+				return fmt.Errorf("%s 字段缺少name或者type", verName)
+			}
+			if fieldNames[field.Name] {
+				return fmt.Errorf("%s 字段重复 %s", verName, field.Name)
+			}
+			if err := field.parse(); err != nil {
+				return fmt.Errorf("%s 字段 %s %s", verName, field.Name, err.Error())
+			}
+			fieldNames[field.Name] = true
+		}
+		if len(tlogModel.Dedup) > 0 && tlogModel.Dedup != dedupSource {
+			dedupNames := make(map[string]bool)
+			for _, name := range splitColumns(tlogModel.Dedup) {
+				if !fieldNames[name] || name == "id" || name == "createtime" || name == "updatetime" || name == dedupColumn {
+					return fmt.Errorf("%s dedup字段不存在 %s", verName, name)
+				}
+				if dedupNames[name] {
+					return fmt.Errorf("%s dedup字段重复 %s", verName, name)
+				}
+				dedupNames[name] = true
+			}
+		}
+		indexNames := map[string]bool{dedupIndex: len(tlogModel.Dedup) > 0}
+		for _, field := range tlogModel.FieldArr {
+			if field.Index {
+				indexNames["i_"+field.Name] = true
+			}
+		}
+		for _, index := range tlogModel.IndexArr {
+			if len(index.Name) <= 0 {
+				return fmt.Errorf("%s 索引缺少name", verName)
+			}
+			if indexNames[index.Name] {
+				return fmt.Errorf("%s 索引重复 %s", verName, index.Name)
+			}
+			indexNames[index.Name] = true
+			columns := splitColumns(index.Columns)
+			if len(columns) <= 0 {
+				return fmt.Errorf("%s 索引 %s 缺少columns", verName, index.Name)
+			}
+			columnNames := make(map[string]bool)
+			for _, column := range columns {
+				if !fieldNames[column] {
+					return fmt.Errorf("%s 索引 %s 字段不存在 %s", verName, index.Name, column)
+				}
+				if columnNames[column] {
+					return fmt.Errorf("%s 索引 %s 字段重复 %s", verName, index.Name, column)
+				}
+				columnNames[column] = true
+			}
+		}
+	}
+	return nil
+}
+
+func splitColumns(columns string) []string {
+	columnArr := make([]string, 0)
+	for _, column := range strings.Split(columns, ",") {
+		if column = strings.TrimSpace(column); len(column) > 0 {
+			columnArr = append(columnArr, column)
+		}
+	}
+	return columnArr
+}
+
+//重新加载xml，新增或者有变化的日志自动建表，自动增加列
+func ReloadModelXml(filename string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	changed, err := loadModelXml(filename)
+	if err != nil {
+		return err
+	}
+	log.Printf("重新加载xml成功 %s, 变化的日志数量=%d\n", filename, len(changed))
+	if len(changed) > 0 {
+		syncDatabase2(changed)
+	}
 	return nil
 }
 
+//每个日志最新的版本
+func latestModels() []*TlogModel {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+	models := make([]*TlogModel, 0)
+	for _, tlogModel := range tlogDict {
+		models = append(models, tlogModel)
+	}
+	return models
+}
+
+//日志中除了日志名、版本和时间的字段，顺序和日志中一致
+func (tlog *TlogModel) LineFields() []*TlogField {
+	if len(tlog.Dedup) > 0 {
+		return tlog.FieldArr[4 : len(tlog.FieldArr)-1]
+	}
+	return tlog.FieldArr[4:]
+}
+
+//是否写入这个目标
+func (tlog *TlogModel) HasSink(name string) bool {
+	if len(tlog.sinkDict) <= 0 {
+		return true
+	}
+	return tlog.sinkDict[name]
+}
+
+//有去重键或者xml中声明了唯一索引，写入时忽略重复的行
+func (tlog *TlogModel) hasUniqueIndex() bool {
+	for _, index := range tlog.indexes {
+		if index.Unique {
+			return true
+		}
+	}
+	return false
+}
+
+//表名，按月分表的话加上月份
+func (tlog *TlogModel) tableName(month int) string {
+	if tlog.Sharding == "month" {
+		return fmt.Sprintf("%s_%d", strings.ToLower(tlog.Name), month)
+	}
+	return strings.ToLower(tlog.Name)
+}
+
 func (tlog *TlogModel) formFieldSql() string {
 	fieldNameArr := make([]string, 0)
 	for _, field := range tlog.FieldArr {
@@ -104,6 +355,15 @@ func (tlog *TlogModel) formFieldSql() string {
 	return sql
 }
 
+//所有索引，有变化的话重新加载xml时检查索引
+func (tlog *TlogModel) formIndexSql() string {
+	indexArr := make([]string, 0)
+	for _, index := range tlog.indexes {
+		indexArr = append(indexArr, index.formIndexSql())
+	}
+	return strings.Join(indexArr, ",")
+}
+
 func (tlog *TlogModel) formCreateTableSQL() string {
 	sql := fmt.Sprintf("CREATE TABLE `%s` (\n", tlog.Name)
 	sql = sql + "\t`id` bigint(11) AUTO_INCREMENT COMMENT 'id',\n"
@@ -120,26 +380,130 @@ func (f *TlogField) formAddColumnSql(tableName string) string {
 	return sql
 }
 
-func (f *TlogField) formAddIndexSql(tableName string) string {
-	sql := fmt.Sprintf("ALTER TABLE %s ADD INDEX i_%s(`%s`)", tableName, f.Name, f.Name)
+func (f *TlogField) formModifyColumnSql(tableName string) string {
+	sql := fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s", tableName, f.formColumnSql())
+	return sql
+}
+
+func (index *TlogIndex) formIndexSql() string {
+	sql := fmt.Sprintf("INDEX `%s`(`%s`)", index.Name, strings.Join(index.columnArr, "`,`"))
+	if index.Unique {
+		sql = "UNIQUE " + sql
+	}
 	return sql
 }
 
+func (index *TlogIndex) formAddIndexSql(tableName string) string {
+	sql := fmt.Sprintf("ALTER TABLE %s ADD %s", tableName, index.formIndexSql())
+	return sql
+}
+
+//索引的字段或者唯一性和xml不一致，删除后重新创建，在一个语句里执行，失败的话保留原来的索引
+func (index *TlogIndex) formRebuildIndexSql(tableName string) string {
+	sql := fmt.Sprintf("ALTER TABLE %s DROP INDEX `%s`, ADD %s", tableName, index.Name, index.formIndexSql())
+	return sql
+}
+
+//sqlite和postgres的索引名在库内唯一，加上表名，i_字段名 为 i_表名_字段名
+func (index *TlogIndex) tableIndexName(tableName string) string {
+	return fmt.Sprintf("i_%s_%s", tableName, strings.TrimPrefix(index.Name, "i_"))
+}
+
+//CREATE [UNIQUE] INDEX IF NOT EXISTS，sqlite和postgres使用
+func (index *TlogIndex) formCreateIndexSql(tableName string) string {
+	sql := "CREATE INDEX"
+	if index.Unique {
+		sql = "CREATE UNIQUE INDEX"
+	}
+	return fmt.Sprintf("%s IF NOT EXISTS %s ON %s (%s)", sql, index.tableIndexName(tableName), tableName, strings.Join(index.columnArr, ", "))
+}
+
 func (f *TlogField) formDropColumnSql(tableName string) string {
 	sql := fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, f.Name)
 	return sql
 }
 
+//mysql的text和json列不能有默认值，写入时空值仍然按默认值转换
 func (f *TlogField) formColumnSql() string {
-	if strings.Index(f.Type, "varchar") == 0 {
-		return fmt.Sprintf("`%s` %s NOT NULL DEFAULT '' COMMENT '%s'", f.Name, f.Type, f.Comment)
+	sql := fmt.Sprintf("`%s` %s", f.Name, f.Type)
+	if f.Unsigned && !strings.Contains(strings.ToLower(f.Type), "unsigned") {
+		sql = sql + " unsigned"
+	}
+	if f.Nullable {
+		sql = sql + " NULL"
 	} else {
-		return fmt.Sprintf("`%s` %s NOT NULL DEFAULT '0' COMMENT '%s'", f.Name, f.Type, f.Comment)
+		sql = sql + " NOT NULL"
+	}
+	if !f.typ.isText() {
+		if v := f.columnDefault(); v == nil {
+			sql = sql + " DEFAULT NULL"
+		} else {
+			sql = sql + fmt.Sprintf(" DEFAULT '%s'", strings.Replace(fmt.Sprint(v), "'", "''", -1))
+		}
+	}
+	return sql + fmt.Sprintf(" COMMENT '%s'", f.Comment)
+}
+
+//解析类型和默认值，unsigned只能用于数字
+func (f *TlogField) parse() error {
+	typ, err := parseFieldType(f.Type)
+	if err != nil {
+		return err
+	}
+	if f.Unsigned {
+		if typ.kind != fieldInt && typ.kind != fieldFloat {
+			return fmt.Errorf("unsigned只能用于数字 %s", f.Type)
+		}
+		typ.unsigned = true
+	}
+	f.typ = typ
+	f.defaultValue = nil
+	if f.Default != nil {
+		if f.defaultValue, err = typ.convert(f.Name, *f.Default); err != nil {
+			return fmt.Errorf("default错误 %s", err.Error())
+		}
 	}
-	return ""
+	return nil
+}
+
+//建表时列的默认值，nil为NULL，没有设置的话为空值转换后的值
+func (f *TlogField) columnDefault() interface{} {
+	if f.Default != nil {
+		return f.defaultValue
+	}
+	if f.Nullable {
+		return nil
+	}
+	v, _ := f.typ.convert(f.Name, "")
+	return v
+}
+
+//一个字段的值，空值有默认值的话写入默认值，可以为NULL的话写入NULL
+func (f *TlogField) value(str string) (interface{}, error) {
+	if len(str) <= 0 {
+		if f.Default != nil {
+			return f.defaultValue, nil
+		}
+		if f.Nullable {
+			return nil, nil
+		}
+	}
+	return f.typ.convert(f.Name, str)
+}
+
+func (f *TlogField) kind() string {
+	return f.typ.kind
+}
+
+//按字段类型检查一行日志，不符合的话返回错误
+func (tlog *TlogModel) CheckRow(row []string) error {
+	_, err := tlog.formInsertArgs(row, "", 0)
+	return err
 }
 
 func GetTlogModel(typ string) *TlogModel {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
 	tlog, ok := tlogVerDict[typ]
 	if !ok {
 		return nil
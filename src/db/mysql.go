@@ -0,0 +1,163 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+type mysqlSink struct {
+	db *sqlx.DB
+}
+
+func newMysqlSink() (Sink, error) {
+	addr := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=%s",
+		config.Ini.MySql.User, config.Ini.MySql.Password, config.Ini.MySql.Ip, config.Ini.MySql.Port, config.Ini.MySql.Db, config.Ini.MySql.Charset)
+	db, err := sqlx.Open("mysql", addr)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("连接数据库成功 %+v\n", addr)
+	return &mysqlSink{db: db}, nil
+}
+
+func (s *mysqlSink) Name() string {
+	return "mysql"
+}
+
+func (s *mysqlSink) tableIsExits(tableName string) bool {
+	_, err := s.db.Exec(fmt.Sprintf("desc %s", tableName))
+	if err == nil {
+		return true
+	}
+	return false
+}
+
+func (s *mysqlSink) CreateTable(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	log.Println("检查创建表", tableName)
+	if s.tableIsExits(tableName) {
+		return nil
+	}
+	//创建表
+	log.Println("创建表", tableName)
+	sql := tlogModel.formCreateTableSQL()
+	sql = strings.Replace(sql, tlogModel.Name, tableName, 1)
+	log.Println(sql)
+	_, err := s.db.Exec(sql)
+	if err != nil {
+		log.Printf("创建表失败, 原因=%s\n", err.Error())
+		return err
+	}
+	for _, index := range tlogModel.indexes {
+		if _, err := s.db.Exec(index.formAddIndexSql(tableName)); err != nil {
+			log.Printf("添加索引失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *mysqlSink) AddColumn(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	log.Println("检查增加列", tableName)
+	schema, err := s.getTableSchema(tableName)
+	if err != nil {
+		log.Printf("获取表结构失败, 原因=%s\n", err.Error())
+		return err
+	}
+	//检查是否有新字段
+	for _, field := range tlogModel.FieldArr {
+		if _, ok := schema.fieldDict[field.Name]; !ok {
+			sql := field.formAddColumnSql(tableName)
+			log.Println(sql)
+			_, err := s.db.Exec(sql)
+			if err != nil {
+				log.Printf("修改表失败, 原因=%s\n", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func (s *mysqlSink) AddIndex(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	indexSchema, err := s.getTableIndexSchema(tableName)
+	if err != nil {
+		log.Printf("获取表索引失败, 原因=%s\n", err.Error())
+		return err
+	}
+	//检查是否有索引，字段或者唯一性不一致的话重建，xml中没有的索引不删除
+	for _, index := range tlogModel.indexes {
+		sql := ""
+		if _, ok := indexSchema.indexDict[index.Name]; !ok {
+			sql = index.formAddIndexSql(tableName)
+		} else if !indexSchema.same(index) {
+			log.Printf("索引不一致 %s %s, 现在的字段=%v\n", tableName, index.Name, indexSchema.columns(index.Name))
+			sql = index.formRebuildIndexSql(tableName)
+		} else {
+			continue
+		}
+		log.Println(sql)
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Printf("添加索引失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *mysqlSink) Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error {
+	now := time.Now().Unix()
+	month := logtime2Month(logtime)
+	tableName := tlogModel.tableName(month)
+	sql := fmt.Sprintf("INSERT INTO %s %s VALUES ", tableName, tlogModel.fieldSql)
+	oneValueArr := make([]string, 0)
+	for range tlogModel.FieldArr {
+		oneValueArr = append(oneValueArr, "?")
+	}
+	valueStr := strings.Join(oneValueArr, ",")
+	valueStr = "(" + valueStr + ")"
+	valueArr := make([]string, 0)
+	for i := 0; i < len(rows); i++ {
+		valueArr = append(valueArr, valueStr)
+	}
+	sql = fmt.Sprintf("%s%s", sql, strings.Join(valueArr, ","))
+	if tlogModel.hasUniqueIndex() {
+		//去重键或者xml中的唯一索引重复的行保留原来的，不让整批失败，不用INSERT IGNORE，其它错误仍然让整批失败
+		sql = sql + " ON DUPLICATE KEY UPDATE id=id"
+	}
+	args := make([]interface{}, 0)
+	for i, row := range rows {
+		rowArgs, err := tlogModel.formInsertArgs(row, sources[i], now)
+		if err != nil {
+			log.Printf("db.mysqlSink.Insert err %+v\n", err)
+			return err
+		}
+		args = append(args, rowArgs...)
+	}
+	debugSql(sql, args)
+	//整批在一个事务里写入，失败的话整批重试
+	tx, err := s.db.Beginx()
+	if err != nil {
+		log.Printf("db.mysqlSink.Insert err %+v\n", err)
+		return err
+	}
+	if _, err := tx.Exec(sql, args...); err != nil {
+		log.Printf("db.mysqlSink.Insert err %+v\n", err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db.mysqlSink.Insert err %+v\n", err)
+		return err
+	}
+	return nil
+}
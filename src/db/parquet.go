@@ -0,0 +1,45 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+//parquet的列，和FieldArr的顺序一致
+func (tlog *TlogModel) ParquetSchema() []string {
+	md := make([]string, 0, len(tlog.FieldArr))
+	for _, field := range tlog.FieldArr {
+		var col string
+		switch field.kind() {
+		case fieldInt:
+			col = fmt.Sprintf("name=%s, type=INT64", field.Name)
+		case fieldFloat:
+			col = fmt.Sprintf("name=%s, type=DOUBLE", field.Name)
+		default:
+			col = fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8", field.Name)
+		}
+		if field.Nullable {
+			col = col + ", repetitiontype=OPTIONAL"
+		}
+		md = append(md, col)
+	}
+	return md
+}
+
+//一行日志写入parquet的值，已经按字段类型转换过，NULL为nil
+func (tlog *TlogModel) ParquetRow(row []string, source string) ([]*string, error) {
+	args, err := tlog.formInsertArgs(row, source, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*string, 0, len(args))
+	for _, arg := range args {
+		if arg == nil {
+			values = append(values, nil)
+			continue
+		}
+		v := fmt.Sprint(arg)
+		values = append(values, &v)
+	}
+	return values, nil
+}
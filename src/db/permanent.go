@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/Shopify/sarama"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+//日志的值不符合字段类型，修改xml后才能写入
+type rowError struct {
+	err error
+}
+
+func (e *rowError) Error() string {
+	return e.err.Error()
+}
+
+//数据或者表结构导致的错误，重试也不会成功，例如字段类型不对、表或者列不存在、语句错误
+var mysqlPermanentErrors = map[uint16]bool{
+	1048: true, //列不能为NULL
+	1054: true, //列不存在
+	1062: true, //唯一索引重复
+	1064: true, //语句错误
+	1136: true, //值的数量和列不一致
+	1146: true, //表不存在
+	1264: true, //超出范围
+	1265: true, //数据被截断
+	1292: true, //值不正确
+	1366: true, //值不正确
+	1406: true, //数据太长
+}
+
+var clickhousePermanentErrors = map[int32]bool{
+	6:  true, //CANNOT_PARSE_TEXT
+	16: true, //NO_SUCH_COLUMN_IN_TABLE
+	27: true, //CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	41: true, //CANNOT_PARSE_DATETIME
+	53: true, //TYPE_MISMATCH
+	60: true, //UNKNOWN_TABLE
+	62: true, //SYNTAX_ERROR
+	69: true, //ARGUMENT_OUT_OF_BOUND
+	70: true, //CANNOT_CONVERT_TYPE
+}
+
+var kafkaPermanentErrors = map[sarama.KError]bool{
+	sarama.ErrInvalidMessage:      true,
+	sarama.ErrInvalidMessageSize:  true,
+	sarama.ErrMessageSizeTooLarge: true,
+	sarama.ErrInvalidRecord:       true,
+}
+
+//写入失败是否重试也不会成功，连接断开、超时、锁等待之类的错误返回false，退避后重试
+func IsPermanent(err error) bool {
+	var rowErr *rowError
+	if errors.As(err, &rowErr) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlPermanentErrors[mysqlErr.Number]
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		//22数据错误 23约束 42语句错误、表或者列不存在
+		switch pqErr.Code.Class() {
+		case "22", "23", "42":
+			return true
+		}
+		return false
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrError, sqlite3.ErrTooBig, sqlite3.ErrConstraint, sqlite3.ErrMismatch, sqlite3.ErrRange:
+			return true
+		}
+		return false
+	}
+	var clickhouseErr *clickhouse.Exception
+	if errors.As(err, &clickhouseErr) {
+		return clickhousePermanentErrors[clickhouseErr.Code]
+	}
+	//一批消息里全部都是不能重试的错误
+	var producerErrs sarama.ProducerErrors
+	if errors.As(err, &producerErrs) && len(producerErrs) > 0 {
+		for _, producerErr := range producerErrs {
+			var kerr sarama.KError
+			if !errors.As(producerErr.Err, &kerr) || !kafkaPermanentErrors[kerr] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
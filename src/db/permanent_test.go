@@ -0,0 +1,42 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/Shopify/sarama"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestIsPermanent(t *testing.T) {
+	cases := []struct {
+		err       error
+		permanent bool
+	}{
+		{&rowError{errors.New("字段 userid 不是整数 abc")}, true},
+		{&mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"}, true},
+		{&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, false},
+		{mysql.ErrInvalidConn, false},
+		{&pq.Error{Code: "42P01"}, true},
+		{&pq.Error{Code: "22P02"}, true},
+		{&pq.Error{Code: "57P01"}, false},
+		{sqlite3.Error{Code: sqlite3.ErrError}, true},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, false},
+		{&clickhouse.Exception{Code: 60}, true},
+		{&clickhouse.Exception{Code: 159}, false},
+		{sarama.ProducerErrors{{Err: sarama.ErrMessageSizeTooLarge}}, true},
+		{sarama.ProducerErrors{{Err: sarama.ErrMessageSizeTooLarge}, {Err: sarama.ErrNotLeaderForPartition}}, false},
+		{fmt.Errorf("写入失败 %w", &mysql.MySQLError{Number: 1054}), true},
+		{io.EOF, false},
+	}
+	for i, c := range cases {
+		if IsPermanent(c.err) != c.permanent {
+			t.Errorf("第%d个 %v 应该是 %v", i, c.err, c.permanent)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//按月分表的日志建成分区表，父表名为日志名，分区名为 日志名_YYYYMM，按logtime分区
+type postgresSink struct {
+	db *sqlx.DB
+}
+
+func newPostgresSink() (Sink, error) {
+	addr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.Ini.Postgres.Host, config.Ini.Postgres.Port, config.Ini.Postgres.User, config.Ini.Postgres.Password, config.Ini.Postgres.Db, config.Ini.Postgres.SslMode)
+	db, err := sqlx.Open("postgres", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	log.Printf("连接数据库成功 postgres %s:%d/%s\n", config.Ini.Postgres.Host, config.Ini.Postgres.Port, config.Ini.Postgres.Db)
+	return &postgresSink{db: db}, nil
+}
+
+func (s *postgresSink) Name() string {
+	return "postgres"
+}
+
+func (s *postgresSink) tableIsExits(tableName string) bool {
+	var exists bool
+	if err := s.db.Get(&exists, "SELECT to_regclass($1) IS NOT NULL", tableName); err != nil {
+		return false
+	}
+	return exists
+}
+
+func (s *postgresSink) CreateTable(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	log.Println("检查创建表", tableName)
+	if !s.tableIsExits(tableName) {
+		log.Println("创建表", tableName)
+		for _, sql := range postgresCreateTableSql(tlogModel, tableName) {
+			log.Println(sql)
+			if _, err := s.db.Exec(sql); err != nil {
+				log.Printf("创建表失败, 原因=%s\n", err.Error())
+				return err
+			}
+		}
+		s.AddIndex(tlogModel, month)
+	}
+	if tlogModel.Sharding != "month" {
+		return nil
+	}
+	//创建当月的分区
+	partitionName := tlogModel.tableName(month)
+	if s.tableIsExits(partitionName) {
+		return nil
+	}
+	monthTime := time.Date(month/100, time.Month(month%100), 1, 0, 0, 0, 0, time.Local)
+	sql := fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)",
+		partitionName, tableName, monthTime.Unix(), monthTime.AddDate(0, 1, 0).Unix())
+	log.Println(sql)
+	if _, err := s.db.Exec(sql); err != nil {
+		log.Printf("创建分区失败, 原因=%s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (s *postgresSink) AddColumn(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	log.Println("检查增加列", tableName)
+	columns := make([]string, 0)
+	if err := s.db.Select(&columns, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", tableName); err != nil {
+		log.Printf("获取表结构失败, 原因=%s\n", err.Error())
+		return err
+	}
+	columnDict := make(map[string]bool)
+	for _, column := range columns {
+		columnDict[column] = true
+	}
+	//检查是否有新字段，分区表加在父表上
+	for _, field := range tlogModel.FieldArr {
+		if columnDict[field.Name] {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, postgresColumnSql(field))
+		log.Println(sql)
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Printf("修改表失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *postgresSink) AddIndex(tlogModel *TlogModel, month int) error {
+	tableName := strings.ToLower(tlogModel.Name)
+	//索引名在schema内唯一，所以带上表名，分区表的索引建在父表上，唯一索引要包含logtime
+	for _, index := range tlogModel.indexes {
+		sql := index.formCreateIndexSql(tableName)
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Println(sql)
+			log.Printf("添加索引失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *postgresSink) Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error {
+	now := time.Now().Unix()
+	//分区表直接写父表
+	tableName := strings.ToLower(tlogModel.Name)
+	valueArr := make([]string, 0)
+	args := make([]interface{}, 0)
+	for i, row := range rows {
+		rowArgs, err := tlogModel.formInsertArgs(row, sources[i], now)
+		if err != nil {
+			log.Printf("db.postgresSink.Insert err %+v\n", err)
+			return err
+		}
+		rowArgs = formatUint64Args(rowArgs)
+		placeholderArr := make([]string, 0)
+		for range rowArgs {
+			placeholderArr = append(placeholderArr, fmt.Sprintf("$%d", len(args)+len(placeholderArr)+1))
+		}
+		valueArr = append(valueArr, "("+strings.Join(placeholderArr, ",")+")")
+		args = append(args, rowArgs...)
+	}
+	sql := fmt.Sprintf("INSERT INTO %s %s VALUES %s", tableName, tlogModel.fieldSql, strings.Join(valueArr, ","))
+	if tlogModel.hasUniqueIndex() {
+		//去重键或者xml中的唯一索引重复的行不写入，同一批里重复的行也只写入第一行
+		sql = sql + " ON CONFLICT DO NOTHING"
+	}
+	debugSql(sql, args)
+	tx, err := s.db.Beginx()
+	if err != nil {
+		log.Printf("db.postgresSink.Insert err %+v\n", err)
+		return err
+	}
+	if _, err := tx.Exec(sql, args...); err != nil {
+		log.Printf("db.postgresSink.Insert err %+v\n", err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db.postgresSink.Insert err %+v\n", err)
+		return err
+	}
+	return nil
+}
+
+func postgresCreateTableSql(tlogModel *TlogModel, tableName string) []string {
+	sql := fmt.Sprintf("CREATE TABLE %s (\n", tableName)
+	sql = sql + "\tid bigserial,\n"
+	for _, field := range tlogModel.FieldArr {
+		sql = sql + fmt.Sprintf("\t%s,\n", postgresColumnSql(field))
+	}
+	if tlogModel.Sharding == "month" {
+		//分区表的主键必须包含分区字段
+		sql = sql + "\tPRIMARY KEY (id, logtime)\n) PARTITION BY RANGE (logtime)"
+	} else {
+		sql = sql + "\tPRIMARY KEY (id)\n)"
+	}
+	sqlArr := []string{sql}
+	sqlArr = append(sqlArr, fmt.Sprintf("COMMENT ON TABLE %s IS %s", tableName, postgresQuote(tlogModel.Comment)))
+	for _, field := range tlogModel.FieldArr {
+		sqlArr = append(sqlArr, fmt.Sprintf("COMMENT ON COLUMN %s.%s IS %s", tableName, field.Name, postgresQuote(field.Comment)))
+	}
+	return sqlArr
+}
+
+//xml里是mysql的类型，转成postgres的类型，unsigned的整数用更大的类型
+func postgresType(field *TlogField) string {
+	t := field.typ
+	switch t.kind {
+	case fieldInt:
+		bits := t.bits
+		if t.unsigned {
+			bits++
+		}
+		switch {
+		case bits <= 16:
+			return "smallint"
+		case bits <= 32:
+			return "integer"
+		case bits <= 64:
+			return "bigint"
+		default:
+			return "numeric(20,0)"
+		}
+	case fieldFloat:
+		switch t.name {
+		case "float":
+			return "real"
+		case "double":
+			return "double precision"
+		}
+		if t.precision > 0 {
+			return fmt.Sprintf("numeric(%d,%d)", t.precision, t.scale)
+		}
+		return "numeric"
+	case fieldDatetime:
+		return "timestamp"
+	case fieldJson:
+		return "jsonb"
+	}
+	if t.length > 0 {
+		return fmt.Sprintf("%s(%d)", t.name, t.length)
+	}
+	return "text"
+}
+
+func postgresColumnSql(field *TlogField) string {
+	sql := fmt.Sprintf("%s %s", field.Name, postgresType(field))
+	if field.Nullable {
+		sql = sql + " NULL"
+	} else {
+		sql = sql + " NOT NULL"
+	}
+	switch v := field.columnDefault().(type) {
+	case nil:
+		return sql + " DEFAULT NULL"
+	case string:
+		return sql + " DEFAULT " + postgresQuote(v)
+	default:
+		return sql + fmt.Sprintf(" DEFAULT %v", v)
+	}
+}
+
+func postgresQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -2,9 +2,6 @@ package db
 
 import (
 	"database/sql"
-	"fmt"
-	"log"
-	"strings"
 )
 
 type fieldSchema struct {
@@ -36,6 +33,7 @@ type indexSchema struct {
 	Comment       string         `db:"Comment"`
 	Index_comment string         `db:"Index_comment"`
 	Visible       string         `db:"Visible"`
+	Expression    sql.NullString `db:"Expression"`
 }
 
 type tableIndexSchema struct {
@@ -43,9 +41,38 @@ type tableIndexSchema struct {
 	indexDict map[string]*indexSchema
 }
 
-func getTableSchema(tableName string) (*tableSchema, error) {
+//索引的字段，按在索引中的顺序，索引不存在返回nil
+func (schema *tableIndexSchema) columns(keyName string) []string {
+	var columns []string
+	for _, index := range schema.indexArr {
+		if index.KeyName != keyName {
+			continue
+		}
+		for len(columns) < index.Seq_in_index {
+			columns = append(columns, "")
+		}
+		columns[index.Seq_in_index-1] = index.ColumnName
+	}
+	return columns
+}
+
+//和xml中的索引是否一致
+func (schema *tableIndexSchema) same(index *TlogIndex) bool {
+	columns := schema.columns(index.Name)
+	if len(columns) != len(index.columnArr) {
+		return false
+	}
+	for i, column := range columns {
+		if column != index.columnArr[i] {
+			return false
+		}
+	}
+	return (schema.indexDict[index.Name].Non_unique == 0) == index.Unique
+}
+
+func (s *mysqlSink) getTableSchema(tableName string) (*tableSchema, error) {
 	fieldArr := make([]*fieldSchema, 0)
-	err := db.Select(&fieldArr, "desc "+tableName)
+	err := s.db.Select(&fieldArr, "desc "+tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -60,9 +87,9 @@ func getTableSchema(tableName string) (*tableSchema, error) {
 	return schema, nil
 }
 
-func getTableIndexSchema(tableName string) (*tableIndexSchema, error) {
+func (s *mysqlSink) getTableIndexSchema(tableName string) (*tableIndexSchema, error) {
 	indexArr := make([]*indexSchema, 0)
-	err := db.Select(&indexArr, "SHOW INDEX FROM "+tableName)
+	err := s.db.Select(&indexArr, "SHOW INDEX FROM "+tableName)
 	if err != nil {
 		return nil, err
 	}
@@ -77,112 +104,29 @@ func getTableIndexSchema(tableName string) (*tableIndexSchema, error) {
 	return schema, nil
 }
 
-func autoCreateTable(suffix int) error {
-	for _, tlogModel := range tlogDict {
-		tableName := tlogModel.Name
-		if tlogModel.Sharding == "month" {
-			tableName = fmt.Sprintf("%s_%d", tlogModel.Name, suffix)
-		}
-		log.Println("检查创建表", tableName)
-		if tableIsExits(tableName) {
-			continue
-		}
-		//创建表
-		log.Println("创建表", tableName)
-		sql := tlogModel.formCreateTableSQL()
-		sql = strings.Replace(sql, tlogModel.Name, tableName, 1)
-		log.Println(sql)
-		_, err := db.Exec(sql)
-		if err != nil {
-			log.Printf("创建表失败, 原因=%s\n", err.Error())
-		}
-		for _, field := range tlogModel.FieldArr {
-			if !field.Index {
-				continue
-			}
-			if _, err := db.Exec(field.formAddIndexSql(tableName)); err != nil {
-				log.Printf("添加索引失败, 原因=%s\n", err.Error())
-			}
-		}
-	}
-	return nil
-}
-
-func autoAddColumn(suffix int) error {
-	for _, tlogModel := range tlogDict {
-		tableName := tlogModel.Name
-		if tlogModel.Sharding == "month" {
-			tableName = fmt.Sprintf("%s_%d", tlogModel.Name, suffix)
-		}
-		log.Println("检查增加列", tableName)
-		schema, err := getTableSchema(tableName)
-		if err != nil {
-			log.Printf("获取表结构失败, 原因=%s\n", err.Error())
-			continue
-		}
-		//检查是否有新字段
-		for _, field := range tlogModel.FieldArr {
-			if _, ok := schema.fieldDict[field.Name]; !ok {
-				sql := field.formAddColumnSql(tableName)
-				log.Println(sql)
-				_, err := db.Exec(sql)
-				if err != nil {
-					log.Printf("修改表失败, 原因=%s\n", err.Error())
-				}
-			}
-		}
-
-		indexSchema, err := getTableIndexSchema(tableName)
-		if err != nil {
-			log.Printf("获取表索引失败, 原因=%s\n", err.Error())
-			continue
-		}
-		//检查是否有索引
-		for _, field := range tlogModel.FieldArr {
-			if !field.Index {
+//只在日志路由到的写入目标中建表
+func autoCreateTable(suffix int, models []*TlogModel) error {
+	for _, sink := range sinks {
+		for _, tlogModel := range models {
+			if !tlogModel.HasSink(sink.Name()) {
 				continue
 			}
-			if _, ok := indexSchema.indexDict["i_"+field.Name]; !ok {
-				sql := field.formAddIndexSql(tableName)
-				log.Println(sql)
-				_, err := db.Exec(sql)
-				if err != nil {
-					log.Printf("添加索引失败, 原因=%s\n", err.Error())
-				}
-			}
+			sink.CreateTable(tlogModel, suffix)
 		}
 	}
 	return nil
 }
 
-func autoDropColumn(suffix int) error {
-	for _, tlogModel := range tlogDict {
-		tableName := tlogModel.Name
-		if tlogModel.Sharding == "month" {
-			tableName = fmt.Sprintf("%s_%d", tlogModel.Name, suffix)
-		}
-		log.Println("检查删除列", tableName)
-		schema, err := getTableSchema(tableName)
-		if err != nil {
-			log.Printf("获取表结构失败, 原因=%s\n", err.Error())
-			continue
-		}
-		//检查是否需要删除字段
-		for _, field := range schema.fieldArr {
-			if field.Field == "id" {
+func autoAddColumn(suffix int, models []*TlogModel) error {
+	for _, sink := range sinks {
+		for _, tlogModel := range models {
+			if !tlogModel.HasSink(sink.Name()) {
 				continue
 			}
-			if field.Field == "version" {
+			if err := sink.AddColumn(tlogModel, suffix); err != nil {
 				continue
 			}
-			if _, ok := tlogModel.fieldDict[field.Field]; !ok {
-				sql := fmt.Sprintf("ALTER TABLE `%s` DROP COLUMN %s", tableName, field.Field)
-				log.Println(sql)
-				_, err := db.Exec(sql)
-				if err != nil {
-					log.Printf("修改表失败, 原因=%s\n", err.Error())
-				}
-			}
+			sink.AddIndex(tlogModel, suffix)
 		}
 	}
 	return nil
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+//写入目标，按月分表时month为YYYYMM
+type Sink interface {
+	Name() string
+	//创建表，已经存在的话什么都不做
+	CreateTable(tlogModel *TlogModel, month int) error
+	//增加表中缺少的列
+	AddColumn(tlogModel *TlogModel, month int) error
+	//增加表中缺少的索引
+	AddIndex(tlogModel *TlogModel, month int) error
+	//批量写入，整批成功或者整批失败，sources为每行去重的来源，不是来自文件的行为空
+	Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error
+}
+
+var sinkCreators = map[string]func() (Sink, error){
+	"mysql":      newMysqlSink,
+	"postgres":   newPostgresSink,
+	"clickhouse": newClickhouseSink,
+	"sqlite":     newSqliteSink,
+	"kafka":      newKafkaSink,
+}
+
+//配置的写入目标
+var sinks []Sink
+
+func newSink(name string) (Sink, error) {
+	creator, ok := sinkCreators[name]
+	if !ok {
+		return nil, fmt.Errorf("不支持的sink %s", name)
+	}
+	return creator()
+}
+
+//多个写入目标用逗号分隔，默认mysql
+func newSinks(names string) ([]Sink, error) {
+	arr := make([]Sink, 0)
+	dict := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) <= 0 {
+			continue
+		}
+		if dict[name] {
+			return nil, fmt.Errorf("sink重复 %s", name)
+		}
+		dict[name] = true
+		sink, err := newSink(name)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, sink)
+	}
+	if len(arr) <= 0 {
+		sink, err := newSink("mysql")
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, sink)
+	}
+	return arr, nil
+}
+
+//所有写入目标
+func GetSinks() []Sink {
+	return sinks
+}
+
+//是否支持的写入目标名
+func IsSinkName(name string) bool {
+	_, ok := sinkCreators[name]
+	return ok
+}
+
+func sinkExists(name string) bool {
+	for _, sink := range sinks {
+		if sink.Name() == name {
+			return true
+		}
+	}
+	return false
+}
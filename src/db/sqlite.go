@@ -0,0 +1,179 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//本地开发和测试用，不需要数据库服务器，按月分表和mysql一样加 _YYYYMM 后缀
+type sqliteSink struct {
+	db *sqlx.DB
+}
+
+func newSqliteSink() (Sink, error) {
+	file := config.Ini.Sqlite.File
+	if len(file) <= 0 {
+		file = "./tlog.db"
+	}
+	db, err := sqlx.Open("sqlite3", file+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	//sqlite同时只能有一个写
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	log.Printf("连接数据库成功 sqlite %s\n", file)
+	return &sqliteSink{db: db}, nil
+}
+
+func (s *sqliteSink) Name() string {
+	return "sqlite"
+}
+
+func (s *sqliteSink) tableIsExits(tableName string) bool {
+	var count int
+	if err := s.db.Get(&count, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", tableName); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func (s *sqliteSink) CreateTable(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	log.Println("检查创建表", tableName)
+	if s.tableIsExits(tableName) {
+		return nil
+	}
+	//创建表
+	log.Println("创建表", tableName)
+	sql := fmt.Sprintf("CREATE TABLE %s (\n", tableName)
+	sql = sql + "\tid INTEGER PRIMARY KEY AUTOINCREMENT"
+	for _, field := range tlogModel.FieldArr {
+		sql = sql + fmt.Sprintf(",\n\t%s", sqliteColumnSql(field))
+	}
+	sql = sql + "\n)"
+	log.Println(sql)
+	if _, err := s.db.Exec(sql); err != nil {
+		log.Printf("创建表失败, 原因=%s\n", err.Error())
+		return err
+	}
+	return s.AddIndex(tlogModel, month)
+}
+
+func (s *sqliteSink) AddColumn(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	log.Println("检查增加列", tableName)
+	columns := make([]string, 0)
+	if err := s.db.Select(&columns, "SELECT name FROM pragma_table_info(?)", tableName); err != nil {
+		log.Printf("获取表结构失败, 原因=%s\n", err.Error())
+		return err
+	}
+	if len(columns) <= 0 {
+		return fmt.Errorf("表不存在 %s", tableName)
+	}
+	columnDict := make(map[string]bool)
+	for _, column := range columns {
+		columnDict[column] = true
+	}
+	//检查是否有新字段
+	for _, field := range tlogModel.FieldArr {
+		if columnDict[field.Name] {
+			continue
+		}
+		sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, sqliteColumnSql(field))
+		log.Println(sql)
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Printf("修改表失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) AddIndex(tlogModel *TlogModel, month int) error {
+	tableName := tlogModel.tableName(month)
+	//索引名在库内唯一，所以带上表名
+	for _, index := range tlogModel.indexes {
+		sql := index.formCreateIndexSql(tableName)
+		if _, err := s.db.Exec(sql); err != nil {
+			log.Println(sql)
+			log.Printf("添加索引失败, 原因=%s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) Insert(tlogModel *TlogModel, rows [][]string, sources []string, logtime int64) error {
+	now := time.Now().Unix()
+	month := logtime2Month(logtime)
+	tableName := tlogModel.tableName(month)
+	valueArr := make([]string, 0)
+	args := make([]interface{}, 0)
+	for i, row := range rows {
+		rowArgs, err := tlogModel.formInsertArgs(row, sources[i], now)
+		if err != nil {
+			log.Printf("db.sqliteSink.Insert err %+v\n", err)
+			return err
+		}
+		rowArgs = formatUint64Args(rowArgs)
+		valueArr = append(valueArr, "("+strings.TrimSuffix(strings.Repeat("?,", len(rowArgs)), ",")+")")
+		args = append(args, rowArgs...)
+	}
+	sql := fmt.Sprintf("INSERT INTO %s %s VALUES %s", tableName, tlogModel.fieldSql, strings.Join(valueArr, ","))
+	if tlogModel.hasUniqueIndex() {
+		sql = sql + " ON CONFLICT DO NOTHING"
+	}
+	debugSql(sql, args)
+	tx, err := s.db.Beginx()
+	if err != nil {
+		log.Printf("db.sqliteSink.Insert err %+v\n", err)
+		return err
+	}
+	if _, err := tx.Exec(sql, args...); err != nil {
+		log.Printf("db.sqliteSink.Insert err %+v\n", err)
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("db.sqliteSink.Insert err %+v\n", err)
+		return err
+	}
+	return nil
+}
+
+//xml里是mysql的类型，按sqlite的类型亲和性转换
+//bigint unsigned超过INTEGER的范围会被转成REAL，用TEXT保存十进制字符串
+func sqliteColumnSql(field *TlogField) string {
+	typ := "TEXT"
+	switch field.kind() {
+	case fieldInt:
+		if !field.typ.unsigned || field.typ.bits < 64 {
+			typ = "INTEGER"
+		}
+	case fieldFloat:
+		if field.typ.name == "decimal" {
+			typ = "NUMERIC"
+		} else {
+			typ = "REAL"
+		}
+	}
+	sql := fmt.Sprintf("%s %s", field.Name, typ)
+	if !field.Nullable {
+		sql = sql + " NOT NULL"
+	}
+	switch v := field.columnDefault().(type) {
+	case nil:
+		return sql + " DEFAULT NULL"
+	case string:
+		return sql + " DEFAULT '" + strings.Replace(v, "'", "''", -1) + "'"
+	default:
+		return sql + fmt.Sprintf(" DEFAULT %v", v)
+	}
+}
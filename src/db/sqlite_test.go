@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+const sqliteTestXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="bind" version="1" comment="绑定">
+        <field name="userid" type="bigint"      comment="用户id"/>
+        <field name="phone"  type="varchar(20)" comment="手机"/>
+        <index name="u_phone" columns="phone" unique="true"/>
+    </tlog>
+</xml>
+`
+
+//xml中声明了唯一索引时，重复的行不写入，同一批里的其它行正常写入
+func TestSqliteUniqueIndexDuplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tlog.xml")
+	if err := ioutil.WriteFile(path, []byte(sqliteTestXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadModelXml(path); err != nil {
+		t.Fatal(err)
+	}
+	config.Ini.Sqlite.File = filepath.Join(dir, "tlog.db")
+	sink, err := newSqliteSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sink.(*sqliteSink)
+	defer s.db.Close()
+	bind := GetTlogModel("bindv1")
+	if err := s.CreateTable(bind, 0); err != nil {
+		t.Fatal(err)
+	}
+	batches := [][][]string{
+		{{"bind", "1", "1600000000", "1", "13800000001"}},
+		{
+			{"bind", "1", "1600000000", "2", "13800000002"},
+			{"bind", "1", "1600000000", "3", "13800000001"},
+			{"bind", "1", "1600000000", "4", "13800000004"},
+		},
+	}
+	for _, rows := range batches {
+		if err := s.Insert(bind, rows, make([]string, len(rows)), 1600000000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userids := make([]int64, 0)
+	if err := s.db.Select(&userids, "SELECT userid FROM bind ORDER BY userid"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(userids) != "[1 2 4]" {
+		t.Fatalf("写入的userid %v，应该是 [1 2 4]", userids)
+	}
+}
+
+const sqliteUnsignedXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="openid" version="1" comment="openid">
+        <field name="hash" type="bigint(20) unsigned" comment="openid的hash"/>
+    </tlog>
+</xml>
+`
+
+//超过int64的bigint unsigned写成十进制字符串，不会失败也不会变成浮点数
+func TestSqliteBigintUnsigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tlog.xml")
+	if err := ioutil.WriteFile(path, []byte(sqliteUnsignedXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadModelXml(path); err != nil {
+		t.Fatal(err)
+	}
+	config.Ini.Sqlite.File = filepath.Join(dir, "tlog.db")
+	sink, err := newSqliteSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sink.(*sqliteSink)
+	defer s.db.Close()
+	openid := GetTlogModel("openidv1")
+	if err := s.CreateTable(openid, 0); err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]string{
+		{"openid", "1", "1600000000", "5"},
+		{"openid", "1", "1600000000", "18446744073709551615"},
+	}
+	if err := s.Insert(openid, rows, make([]string, len(rows)), 1600000000); err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([]string, 0)
+	if err := s.db.Select(&hashes, "SELECT hash FROM openid ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hashes) != "[5 18446744073709551615]" {
+		t.Fatalf("写入的hash %v", hashes)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//日志被拒绝的原因
+const (
+	rejectFormat  = "format"  //格式错误
+	rejectUnknown = "unknown" //xml里没有这个版本
+	rejectLength  = "length"  //字段数量不对
+	rejectField   = "field"   //字段的值不符合类型
+	rejectInsert  = "insert"  //写入失败，重试也不会成功或者超过最大写入次数
+)
+
+//被拒绝的日志写到死信目录，每个原因和类型一个文件，修改xml后可以重放
+//各个来源的协程都会写入
+type deadLetter struct {
+	lock  sync.Mutex
+	dir   string
+	files map[string]*os.File
+}
+
+func newDeadLetter(dir string) *deadLetter {
+	return &deadLetter{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}
+}
+
+//一行的格式: 来源\t行号\t原始日志
+func (d *deadLetter) write(reason string, typ string, tline *tlogLine) error {
+	if len(d.dir) <= 0 {
+		return nil
+	}
+	if len(typ) <= 0 || strings.ContainsAny(typ, "/\\.\t ") {
+		typ = "invalid"
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	filename := filepath.Join(d.dir, fmt.Sprintf("%s_%s.log", reason, typ))
+	file, ok := d.files[filename]
+	if !ok {
+		if err := os.MkdirAll(d.dir, 0755); err != nil {
+			return err
+		}
+		var err error
+		file, err = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		d.files[filename] = file
+	}
+	_, err := fmt.Fprintf(file, "%s\t%d\t%s\n", tline.source, tline.lineno, tline.text)
+	return err
+}
+
+//写入一个目标失败的日志，每个目标一个文件 insert_目标_类型.log，重放时只写入这个目标，已经写入的目标不会重复
+func (d *deadLetter) writeInsert(sink string, typ string, tline *tlogLine) error {
+	return d.write(rejectInsert+"_"+sink, typ, tline)
+}
+
+//写入失败的死信文件对应的目标，其它死信文件返回空
+func deadLetterSink(name string) string {
+	args := strings.SplitN(name, "_", 3)
+	if len(args) != 3 || args[0] != rejectInsert || !db.IsSinkName(args[1]) {
+		return ""
+	}
+	return args[1]
+}
+
+func (d *deadLetter) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for filename, file := range d.files {
+		file.Close()
+		delete(d.files, filename)
+	}
+}
+
+func (s *LogSync) reject(reason string, typ string, tline *tlogLine) {
+	metrics.LinesRejected.WithLabelValues(reason).Inc()
+	if err := s.deadLetter.write(reason, typ, tline); err != nil {
+		log.Println("写入死信失败", err)
+	}
+	if tline.ack != nil {
+		tline.ack.reject()
+	}
+}
+
+//重放死信目录里的日志，仍然不符合的会重新写到死信目录
+func (s *LogSync) replayDeadLetter() error {
+	dir := config.Ini.Tlog.DeadLetterDir
+	if len(dir) <= 0 {
+		return fmt.Errorf("没有配置死信目录")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		//.replay是上次没有重放完的文件
+		if ext := filepath.Ext(info.Name()); ext == ".log" || ext == ".replay" {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sink := deadLetterSink(name); len(sink) > 0 && !s.hasOutput(sink) {
+			log.Println("没有配置写入目标", sink, "跳过死信", name)
+			continue
+		}
+		path := filepath.Join(dir, name)
+		replayPath := path
+		if filepath.Ext(name) == ".log" {
+			//先改名，重放时被拒绝的日志写到新的文件
+			replayPath = path + ".replay"
+			if err := os.Rename(path, replayPath); err != nil {
+				return err
+			}
+		}
+		if err := s.replayFile(replayPath); err != nil {
+			return err
+		}
+		if err := os.Remove(replayPath); err != nil {
+			return err
+		}
+	}
+	//写入失败的批次保存到重试目录，下次启动时重试
+	s.stopPipeline()
+	s.deadLetter.close()
+	return nil
+}
+
+func (s *LogSync) replayFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	log.Println("重放死信", path)
+	sink := deadLetterSink(filepath.Base(path))
+	count := 0
+	buff := bufio.NewReader(file)
+	for {
+		line, err := buff.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		args := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 3)
+		if len(args) != 3 {
+			log.Println("无效死信", line)
+			continue
+		}
+		lineno, _ := strconv.Atoi(args[1])
+		//重放的行不属于正在同步的文件，不影响同步进度
+		s.syncTlog(&tlogLine{
+			text:   args[2],
+			source: args[0],
+			lineno: lineno,
+			sink:   sink,
+		})
+		count++
+	}
+	s.flushOutputs()
+	log.Printf("重放死信完成 %s, 行数=%d\n", path, count)
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shark/minigame-tlogsync/db"
+)
+
+//写入失败的死信文件名里有目标，重放时只写入这个目标
+func TestDeadLetterSink(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{"insert_mysql_pay.log", "mysql"},
+		{"insert_clickhouse_user_login.log.replay", "clickhouse"},
+		{"insert_pay.log", ""},
+		{"insert_user_login.log", ""},
+		{"field_mysql_pay.log", ""},
+		{"format_invalid.log", ""},
+	}
+	for _, test := range tests {
+		if sink := deadLetterSink(test.name); sink != test.expect {
+			t.Errorf("%s 的目标是 %s，应该是 %s", test.name, sink, test.expect)
+		}
+	}
+	mysql := &sinkOutput{name: "mysql"}
+	clickhouse := &sinkOutput{name: "clickhouse"}
+	s := &LogSync{outputs: []*sinkOutput{mysql, clickhouse}}
+	tlogModel := &db.TlogModel{Name: "pay", Version: 1}
+	if outs := s.routeOutputs(&tlogLine{sink: "clickhouse"}, tlogModel); len(outs) != 1 || outs[0] != clickhouse {
+		t.Errorf("重放写入失败的死信写入了%d个目标", len(outs))
+	}
+	if outs := s.routeOutputs(&tlogLine{}, tlogModel); len(outs) != 2 {
+		t.Errorf("其它日志写入了%d个目标", len(outs))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//分帧协议，所有整数都是大端
+//请求: 长度(4字节) 序号(8字节) 日志(长度个字节，多行用\n分隔)
+//确认: 序号(8字节) 状态(1字节) 被拒绝的行数(4字节)
+//日志全部写入数据库(或者被拒绝写入死信、保存到tcp缓冲)后才回复确认，客户端重发没有确认的批次
+const (
+	frameHeaderSize = 12
+	frameAckSize    = 13
+	frameMaxSize    = 16 << 20
+)
+
+//确认状态
+const (
+	ackOk       = 0 //已经写入
+	ackError    = 1 //请求错误，服务器会断开链接
+	ackOverload = 2 //超过限速或者队列和缓冲都满了，这一帧没有接收，客户端稍后重发或者写到本地文件
+)
+
+//需要确认的一批日志，全部写入或者被拒绝后回调，不同的写入协程会同时确认
+type ackGroup struct {
+	lock     sync.Mutex
+	pending  int
+	rejected int
+	done     func(rejected int)
+}
+
+//一行日志要写入多个目标时增加等待的数量
+func (g *ackGroup) add(n int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pending += n
+}
+
+func (g *ackGroup) commit() {
+	g.lock.Lock()
+	g.pending--
+	finished, rejected := g.pending == 0, g.rejected
+	g.lock.Unlock()
+	if finished {
+		g.done(rejected)
+	}
+}
+
+func (g *ackGroup) reject() {
+	g.lock.Lock()
+	g.rejected++
+	g.lock.Unlock()
+	g.commit()
+}
+
+//一帧日志
+type tlogBatch struct {
+	lines []*tlogLine
+	ack   *ackGroup
+}
+
+type frameAck struct {
+	seq      uint64
+	status   byte
+	rejected int
+}
+
+func (s *LogSync) handleFrameConnection(conn net.Conn) {
+	log.Println("接受tcp链接(分帧协议)")
+	defer conn.Close()
+	metrics.TcpConnections.Inc()
+	defer metrics.TcpConnections.Dec()
+	source := "tcp:" + conn.RemoteAddr().String()
+	lineno := 0
+	limiter := newRateLimiter(config.Ini.Tlog.RateLimit)
+	//确认由写入协程回复，满了的话丢弃，客户端会重发
+	ackChan := make(chan *frameAck, 1024)
+	chQuit := make(chan bool)
+	defer close(chQuit)
+	go func() {
+		buff := make([]byte, frameAckSize)
+		for {
+			select {
+			case ack := <-ackChan:
+				binary.BigEndian.PutUint64(buff[0:8], ack.seq)
+				buff[8] = ack.status
+				binary.BigEndian.PutUint32(buff[9:13], uint32(ack.rejected))
+				if _, err := conn.Write(buff); err != nil {
+					log.Println("回复确认失败", err)
+					return
+				}
+			case <-chQuit:
+				return
+			}
+		}
+	}()
+	sendAck := func(ack *frameAck) {
+		select {
+		case ackChan <- ack:
+		default:
+			log.Println("确认队列已满,丢弃确认", ack.seq)
+		}
+	}
+	reader := bufio.NewReader(conn)
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				log.Println("读取帧失败", err)
+			}
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		seq := binary.BigEndian.Uint64(header[4:12])
+		if length > frameMaxSize {
+			log.Println("帧太大", length)
+			sendAck(&frameAck{seq: seq, status: ackError})
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			log.Println("读取帧失败", err)
+			break
+		}
+		batch := &tlogBatch{
+			lines: make([]*tlogLine, 0),
+		}
+		for _, line := range strings.Split(string(payload), "\n") {
+			lineno++
+			if len(strings.TrimSpace(line)) <= 0 {
+				continue
+			}
+			batch.lines = append(batch.lines, &tlogLine{
+				text:   line,
+				source: source,
+				lineno: lineno,
+			})
+		}
+		if len(batch.lines) <= 0 {
+			sendAck(&frameAck{seq: seq, status: ackOk})
+			continue
+		}
+		batch.ack = &ackGroup{
+			pending: len(batch.lines),
+			done: func(rejected int) {
+				sendAck(&frameAck{seq: seq, status: ackOk, rejected: rejected})
+			},
+		}
+		for _, line := range batch.lines {
+			line.ack = batch.ack
+		}
+		if !limiter.allow(len(batch.lines)) {
+			metrics.TcpOverload.WithLabelValues("ratelimit").Add(float64(len(batch.lines)))
+			sendAck(&frameAck{seq: seq, status: ackOverload})
+			continue
+		}
+		if !s.acceptTcp(batch.lines, true) {
+			metrics.TcpOverload.WithLabelValues("full").Add(float64(len(batch.lines)))
+			sendAck(&frameAck{seq: seq, status: ackOverload})
+			continue
+		}
+		//需要确认的批次马上写入
+		s.requestFlush()
+	}
+	log.Println("断开tcp链接")
+}
@@ -3,8 +3,17 @@ module github.com/shark/minigame-tlogsync
 go 1.16
 
 require (
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/ClickHouse/clickhouse-go v1.5.4
+	github.com/Shopify/sarama v1.29.0
+	github.com/apache/thrift v0.14.2
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/jmoiron/sqlx v1.3.4
+	github.com/klauspost/compress v1.13.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/prometheus/client_golang v1.11.1
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	gopkg.in/ini.v1 v1.62.0
 )
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+)
+
+const httpMaxBodySize = 16 << 20
+
+//json格式的一条日志
+type httpRecord struct {
+	Name    string                 `json:"name"`
+	Version int32                  `json:"version"`
+	Logtime int64                  `json:"logtime"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+//每一行的处理结果
+type httpResult struct {
+	Line   int    `json:"line"`
+	Ok     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type httpResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []*httpResult `json:"results"`
+}
+
+//调用前shutDownGroup加1，等正在处理的请求都结束后才减1，之后才能关闭同步队列
+func (s *LogSync) listenAndServeHttp() {
+	defer s.shutDownGroup.Done()
+	if len(config.Ini.Http.Listen) <= 0 {
+		return
+	}
+	path := config.Ini.Http.Path
+	if len(path) <= 0 {
+		path = "/tlog"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		s.httpGroup.Add(1)
+		defer s.httpGroup.Done()
+		s.handleHttpTlog(w, r)
+	})
+	if len(config.Ini.Http.Metrics) > 0 {
+		mux.Handle(config.Ini.Http.Metrics, promhttp.Handler())
+	}
+	server := &http.Server{
+		Addr:    config.Ini.Http.Listen,
+		Handler: mux,
+	}
+	log.Println("监听http", config.Ini.Http.Listen, path)
+	chShutDown := make(chan bool)
+	go func() {
+		defer close(chShutDown)
+		<-s.chDie
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			//超时的话断开还没结束的链接，下面等处理函数返回
+			log.Println("关闭http超时", err)
+			server.Close()
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalln(err)
+	}
+	//ListenAndServe在Shutdown开始时就返回，要等Shutdown结束和处理函数都返回
+	<-chShutDown
+	s.httpGroup.Wait()
+	log.Println("http done")
+}
+
+//接收一行或者多行日志，也可以是json数组，同步检查格式后返回每一行的结果
+func (s *LogSync) handleHttpTlog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, httpMaxBodySize)
+	var lines []string
+	var results []*httpResult
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		lines, results, err = readHttpRecords(body)
+	} else {
+		lines, results, err = readHttpLines(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source := "http:" + r.RemoteAddr
+	resp := &httpResponse{
+		Results: results,
+	}
+	for i, line := range lines {
+		result := results[i]
+		if result.Ok {
+			if _, _, reason, err := checkTlog(line); err != nil {
+				result.Ok = false
+				result.Reason = reason
+				result.Error = err.Error()
+			}
+		}
+		if !result.Ok {
+			resp.Rejected++
+			continue
+		}
+		resp.Accepted++
+		s.syncTlog(&tlogLine{
+			text:   line,
+			source: source,
+			lineno: result.Line,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func readHttpLines(body io.Reader) ([]string, []*httpResult, error) {
+	lines := make([]string, 0)
+	results := make([]*httpResult, 0)
+	lineno := 0
+	buff := bufio.NewReader(body)
+	for {
+		line, err := buff.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		lineno++
+		if text := strings.TrimSpace(line); len(text) > 0 {
+			lines = append(lines, text)
+			results = append(results, &httpResult{Line: lineno, Ok: true})
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return lines, results, nil
+}
+
+func readHttpRecords(body io.Reader) ([]string, []*httpResult, error) {
+	records := make([]*httpRecord, 0)
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&records); err != nil {
+		return nil, nil, err
+	}
+	lines := make([]string, 0)
+	results := make([]*httpResult, 0)
+	for i, record := range records {
+		result := &httpResult{Line: i + 1, Ok: true}
+		line, err := record.formLine()
+		if err != nil {
+			result.Ok = false
+			result.Reason = rejectFormat
+			result.Error = err.Error()
+		}
+		lines = append(lines, line)
+		results = append(results, result)
+	}
+	return lines, results, nil
+}
+
+//按xml里字段的顺序拼成一行日志
+func (r *httpRecord) formLine() (string, error) {
+	if r == nil {
+		return "", fmt.Errorf("日志为空")
+	}
+	tlogModel := db.GetTlogModel(fmt.Sprintf("%sv%d", r.Name, r.Version))
+	if tlogModel == nil {
+		return fmt.Sprintf("%s|%d|%d", r.Name, r.Version, r.Logtime), nil
+	}
+	args := []string{r.Name, fmt.Sprint(r.Version), fmt.Sprint(r.Logtime)}
+	for _, field := range tlogModel.LineFields() {
+		value, ok := r.Fields[field.Name]
+		if !ok {
+			return "", fmt.Errorf("缺少字段 %s", field.Name)
+		}
+		var str string
+		switch v := value.(type) {
+		case nil:
+			str = ""
+		case string:
+			str = v
+		case bool:
+			if v {
+				str = "1"
+			} else {
+				str = "0"
+			}
+		default:
+			str = fmt.Sprint(v)
+		}
+		if strings.ContainsAny(str, "|\r\n") {
+			return "", fmt.Errorf("字段 %s 不能包含分隔符或者换行", field.Name)
+		}
+		args = append(args, str)
+	}
+	return strings.Join(args, "|"), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+//消费kafka中的日志，每条消息一行或者多行
+//消息中的日志全部写入(或者被拒绝写入死信)后才提交这条消息的位置，中断后没有提交的消息会重新消费
+type kafkaConsumer struct {
+	sync *LogSync
+}
+
+//一个分区中还没写入的消息，只提交从头开始连续写入的位置
+type kafkaPartition struct {
+	lock      sync.Mutex
+	sess      sarama.ConsumerGroupSession
+	topic     string
+	partition int32
+	offsets   []int64
+	done      map[int64]bool
+}
+
+func (p *kafkaPartition) add(offset int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.offsets = append(p.offsets, offset)
+}
+
+//在同步协程中回调
+func (p *kafkaPartition) commit(offset int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done[offset] = true
+	mark := int64(-1)
+	for len(p.offsets) > 0 && p.done[p.offsets[0]] {
+		mark = p.offsets[0]
+		delete(p.done, mark)
+		p.offsets = p.offsets[1:]
+	}
+	//重新分配分区后旧的会话不能再提交
+	if mark < 0 || p.sess.Context().Err() != nil {
+		return
+	}
+	p.sess.MarkOffset(p.topic, p.partition, mark+1, "")
+}
+
+//调用前shutDownGroup加1，消费的日志都交给同步队列后才减1，之后才能关闭同步队列
+func (s *LogSync) consumeKafka() {
+	defer s.shutDownGroup.Done()
+	topics := splitList(config.Ini.Kafka.ConsumeTopics)
+	if len(topics) <= 0 {
+		return
+	}
+	groupId := config.Ini.Kafka.ConsumeGroup
+	if len(groupId) <= 0 {
+		groupId = "tlogsync"
+	}
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "tlogsync"
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+	cfg.Consumer.Return.Errors = true
+	group, err := sarama.NewConsumerGroup(splitList(config.Ini.Kafka.Brokers), groupId, cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("消费kafka", topics, "group", groupId)
+	defer func() {
+		log.Println("kafka done")
+		group.Close()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.chDie
+		cancel()
+	}()
+	go func() {
+		for err := range group.Errors() {
+			log.Println("消费kafka失败", err)
+		}
+	}()
+	consumer := &kafkaConsumer{sync: s}
+	for {
+		//重新分配分区后返回，需要再次调用
+		if err := group.Consume(ctx, topics, consumer); err != nil {
+			log.Println("消费kafka失败", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (c *kafkaConsumer) Setup(sess sarama.ConsumerGroupSession) error {
+	log.Println("分配kafka分区", sess.Claims())
+	return nil
+}
+
+func (c *kafkaConsumer) Cleanup(sess sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (c *kafkaConsumer) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	p := &kafkaPartition{
+		sess:      sess,
+		topic:     claim.Topic(),
+		partition: claim.Partition(),
+		offsets:   make([]int64, 0),
+		done:      make(map[int64]bool),
+	}
+	source := fmt.Sprintf("kafka:%s/%d", claim.Topic(), claim.Partition())
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			{
+				if !ok {
+					return nil
+				}
+				if !c.push(p, source, msg) {
+					return nil
+				}
+			}
+		case <-sess.Context().Done():
+			{
+				return nil
+			}
+		}
+	}
+}
+
+//把消息中的日志交给同步协程，退出的话返回false
+func (c *kafkaConsumer) push(p *kafkaPartition, source string, msg *sarama.ConsumerMessage) bool {
+	lines := make([]*tlogLine, 0)
+	for _, line := range strings.Split(string(msg.Value), "\n") {
+		if len(strings.TrimSpace(line)) <= 0 {
+			continue
+		}
+		lines = append(lines, &tlogLine{
+			text:   line,
+			source: source,
+			lineno: int(msg.Offset),
+		})
+	}
+	p.add(msg.Offset)
+	if len(lines) <= 0 {
+		p.commit(msg.Offset)
+		return true
+	}
+	offset := msg.Offset
+	ack := &ackGroup{
+		pending: len(lines),
+		done: func(rejected int) {
+			p.commit(offset)
+		},
+	}
+	for _, line := range lines {
+		line.ack = ack
+	}
+	for _, line := range lines {
+		select {
+		case <-c.sync.chDie:
+			return false
+		default:
+		}
+		c.sync.syncTlog(line)
+	}
+	return true
+}
+
+//逗号分隔的列表
+func splitList(str string) []string {
+	arr := make([]string, 0)
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			arr = append(arr, item)
+		}
+	}
+	return arr
+}
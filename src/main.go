@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -8,8 +9,8 @@ import (
 	"syscall"
 	"time"
 
-	_ "github.com/shark/minigame-tlogsync/config"
-	_ "github.com/shark/minigame-tlogsync/db"
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
 )
 
 func atoi32(s string) int32 {
@@ -36,18 +37,49 @@ func isSameMonth(s1 int64, s2 int64) bool {
 	return false
 }
 
+var replay = flag.Bool("replay", false, "重放死信目录里的日志后退出")
+var migrate = flag.Bool("migrate", false, "打印让已经存在的表和xml一致需要执行的语句后退出")
+var confirm = flag.Bool("confirm", false, "和-migrate一起使用，执行打印的语句")
+
 func main() {
+	flag.Parse()
+	if err := config.Load("config.ini"); err != nil {
+		log.Fatalln(err)
+	}
+	if err := db.Init(); err != nil {
+		log.Fatalln(err)
+	}
+	if *migrate {
+		if err := db.Migrate(*confirm); err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("[main] migrate done")
+		return
+	}
+	db.SyncDatabase()
 	sync, err := newLogSync()
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if *replay {
+		if err := sync.replayDeadLetter(); err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("[main] replay done")
+		return
+	}
 	sync.run()
-	sg := make(chan os.Signal)
-	signal.Notify(sg, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGTERM)
-	select {
-	case s := <-sg:
+	sg := make(chan os.Signal, 1)
+	signal.Notify(sg, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
+	for s := range sg {
 		log.Println("[main] got signal", s)
+		//SIGHUP重新加载xml
+		if s == syscall.SIGHUP {
+			sync.reloadXml()
+			continue
+		}
 		sync.shutDown()
+		break
 	}
 	log.Printf("[main] quit")
 }
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	//读取的日志行数
+	LinesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlogsync_lines_read_total",
+		Help: "读取的日志行数",
+	}, []string{"type", "version"})
+	//被拒绝的日志行数
+	LinesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlogsync_lines_rejected_total",
+		Help: "被拒绝的日志行数",
+	}, []string{"reason"})
+	//写入数据库的行数
+	RowsInserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlogsync_rows_inserted_total",
+		Help: "写入数据库的行数",
+	}, []string{"sink", "type"})
+	//写入数据库失败的批次
+	InsertErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlogsync_insert_errors_total",
+		Help: "写入数据库失败的批次",
+	}, []string{"sink", "type"})
+	//批量写入耗时
+	InsertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tlogsync_insert_duration_seconds",
+		Help:    "批量写入耗时",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"sink", "type"})
+	//缓存中还没写入的行数
+	CacheLines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tlogsync_cache_lines",
+		Help: "缓存中还没写入的行数",
+	}, []string{"sink", "type"})
+	//等待写入和重试的批次
+	RetryBatches = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tlogsync_retry_batches",
+		Help: "等待写入和重试的批次",
+	}, []string{"sink"})
+	//日志目录中等待同步的文件
+	PendingFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tlogsync_pending_files",
+		Help: "日志目录中等待同步的文件",
+	})
+	//当前tcp链接数
+	TcpConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tlogsync_tcp_connections",
+		Help: "当前tcp链接数",
+	})
+	//tcp过载的日志行数，分帧协议没有接收，按行的协议等待后接收
+	TcpOverload = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tlogsync_tcp_overload_total",
+		Help: "tcp过载的日志行数",
+	}, []string{"reason"})
+	//tcp缓冲目录中还没重新同步的大小
+	SpoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tlogsync_spool_bytes",
+		Help: "tcp缓冲目录中还没重新同步的大小",
+	})
+)
+
+//最早一行还没写入的日志的读取时间，UnixNano
+var oldestUnflushed int64
+
+func init() {
+	prometheus.MustRegister(LinesRead, LinesRejected, RowsInserted, InsertErrors, InsertDuration,
+		CacheLines, RetryBatches, PendingFiles, TcpConnections, TcpOverload, SpoolBytes)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "tlogsync_oldest_unflushed_seconds",
+		Help: "最早一行还没写入的日志已经等待的时间",
+	}, func() float64 {
+		t := atomic.LoadInt64(&oldestUnflushed)
+		if t == 0 {
+			return 0
+		}
+		return time.Since(time.Unix(0, t)).Seconds()
+	}))
+}
+
+//设置最早一行还没写入的日志的读取时间，没有的话传零值
+func SetOldestUnflushed(t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(&oldestUnflushed, 0)
+		return
+	}
+	atomic.StoreInt64(&oldestUnflushed, t.UnixNano())
+}
+
+//udp统计由调用方用原子操作维护
+func RegisterUdp(packets *int64, malformed *int64, dropped *int64) {
+	counters := []struct {
+		name  string
+		help  string
+		value *int64
+	}{
+		{"tlogsync_udp_packets_total", "收到的udp包", packets},
+		{"tlogsync_udp_malformed_total", "格式错误的udp包", malformed},
+		{"tlogsync_udp_dropped_total", "队列满了丢弃的udp日志", dropped},
+	}
+	for _, counter := range counters {
+		value := counter.value
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: counter.name,
+			Help: counter.help,
+		}, func() float64 {
+			return float64(atomic.LoadInt64(value))
+		}))
+	}
+}
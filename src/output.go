@@ -0,0 +1,328 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//一个写入目标，有自己的写入协程、重试队列和同步进度
+//慢的目标只会让自己的队列变长，超过内存上限的批次写到磁盘，不会阻塞其它目标
+type sinkOutput struct {
+	name       string
+	sink       db.Sink
+	checkpoint *checkpointStore
+	retryDir   string
+	deadLetter *deadLetter //放弃写入的批次
+	slots      chan bool   //同时写入的数量
+	lock       sync.Mutex
+	writers    map[string]*sinkWriter
+}
+
+//一种日志在一个目标的写入协程，按顺序写入，失败的话只有这种日志退避重试
+type sinkWriter struct {
+	out       *sinkOutput
+	typ       string
+	retry     *retryQueue
+	cacheChan chan *Cache
+	waitChan  chan chan bool
+	chDone    chan bool
+	oldest    int64 //队列里最早的日志的读取时间，UnixNano，给监控用
+}
+
+//每个写入目标每种日志一个写入协程，多个目标时各自使用 进度文件.目标名 和 重试目录/目标名
+func newSinkOutputs(deadLetter *deadLetter) ([]*sinkOutput, error) {
+	sinks := db.GetSinks()
+	outputs := make([]*sinkOutput, 0)
+	for _, sink := range sinks {
+		checkpointFile := config.Ini.Tlog.Checkpoint
+		fallback := ""
+		retryDir := config.Ini.Tlog.RetryDir
+		if len(sinks) > 1 {
+			if len(checkpointFile) > 0 {
+				fallback = checkpointFile
+				checkpointFile = checkpointFile + "." + sink.Name()
+			}
+			if len(retryDir) > 0 {
+				retryDir = filepath.Join(retryDir, sink.Name())
+			}
+		}
+		checkpoint, err := newCheckpointStore(checkpointFile, fallback)
+		if err != nil {
+			return nil, err
+		}
+		queues, err := loadRetryQueues(sink.Name(), retryDir)
+		if err != nil {
+			return nil, err
+		}
+		writers := config.Ini.Tlog.Writers
+		if writers <= 0 {
+			writers = 4
+		}
+		out := &sinkOutput{
+			name:       sink.Name(),
+			sink:       sink,
+			checkpoint: checkpoint,
+			retryDir:   retryDir,
+			deadLetter: deadLetter,
+			slots:      make(chan bool, writers),
+			writers:    make(map[string]*sinkWriter),
+		}
+		//上次退出时没写完的批次先写
+		for typ, q := range queues {
+			out.startWriter(typ, q)
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
+
+//这种日志的写入协程，第一次写入时启动
+func (out *sinkOutput) writer(typ string) *sinkWriter {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	if w, ok := out.writers[typ]; ok {
+		return w
+	}
+	return out.startWriter(typ, newRetryQueue(out.name, typ, out.retryDir))
+}
+
+//调用前要加锁
+func (out *sinkOutput) startWriter(typ string, q *retryQueue) *sinkWriter {
+	w := &sinkWriter{
+		out:       out,
+		typ:       typ,
+		retry:     q,
+		cacheChan: make(chan *Cache, 1),
+		waitChan:  make(chan chan bool),
+		chDone:    make(chan bool),
+	}
+	w.updateOldest()
+	out.writers[typ] = w
+	go w.writeLoop()
+	return w
+}
+
+func (out *sinkOutput) allWriters() []*sinkWriter {
+	out.lock.Lock()
+	defer out.lock.Unlock()
+	writers := make([]*sinkWriter, 0, len(out.writers))
+	for _, w := range out.writers {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+//关闭写入队列，等写入协程把队列写完或者写到磁盘后退出
+func (out *sinkOutput) stop() {
+	writers := out.allWriters()
+	for _, w := range writers {
+		close(w.cacheChan)
+	}
+	for _, w := range writers {
+		<-w.chDone
+	}
+}
+
+//写入队列头部的批次，失败的话留在队列头部退避后重试
+//写入在单独的协程里，写入时也接收新的批次加入队列，超过内存上限的写到磁盘，批次协程不会因为这个目标慢而等待
+//没有配置重试目录时队列不能写到磁盘，超过内存上限后不再接收，批次协程等待
+//队列关闭后写完正在写入的批次，把剩下的批次写到磁盘
+func (w *sinkWriter) writeLoop() {
+	defer close(w.chDone)
+	q := w.retry
+	cacheChan := w.cacheChan
+	waits := make([]chan bool, 0)
+	var writing *Cache
+	resultChan := make(chan error, 1)
+	for {
+		if writing == nil && q.len() > 0 && !time.Now().Before(q.nextTime) {
+			writing = w.writeNext(resultChan)
+			continue
+		}
+		if writing == nil {
+			for _, ch := range waits {
+				close(ch)
+			}
+			waits = waits[:0]
+			if cacheChan == nil {
+				q.spillAll()
+				return
+			}
+		}
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if writing == nil && q.len() > 0 {
+			timer = time.NewTimer(time.Until(q.nextTime))
+			retry = timer.C
+		}
+		recvChan := cacheChan
+		if len(q.dir) <= 0 && q.len() >= maxMemoryBatches() {
+			recvChan = nil
+		}
+		select {
+		case cache, ok := <-recvChan:
+			{
+				if ok {
+					w.push(cache)
+				} else {
+					cacheChan = nil
+				}
+			}
+		case ch := <-w.waitChan:
+			{
+				//先把已经交给这个协程的批次加入队列，写完再通知
+				for len(cacheChan) > 0 {
+					w.push(<-cacheChan)
+				}
+				waits = append(waits, ch)
+			}
+		case err := <-resultChan:
+			{
+				w.finishNext(writing, err)
+				writing = nil
+			}
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+//没有重试目录时每种日志每个目标内存中最多的批次，至少一个
+func maxMemoryBatches() int {
+	if config.Ini.Tlog.RetryMemory > 1 {
+		return config.Ini.Tlog.RetryMemory
+	}
+	return 1
+}
+
+func (w *sinkWriter) push(cache *Cache) {
+	w.retry.push(w.typ, cache)
+	w.updateOldest()
+}
+
+//在单独的协程里写入队列头部的批次，同时写入的数量满了的话等待，结果交给写入协程
+func (w *sinkWriter) writeNext(resultChan chan error) *Cache {
+	q := w.retry
+	cache, err := q.load(q.batches[0])
+	if err != nil {
+		log.Println("加载重试批次失败", q.batches[0].spillFile, err)
+		q.pop()
+		w.updateOldest()
+		return nil
+	}
+	go func() {
+		w.out.slots <- true
+		err := w.out.writeCache(w.typ, cache)
+		<-w.out.slots
+		resultChan <- err
+	}()
+	return cache
+}
+
+//重试也不会成功的错误或者超过最大写入次数时放弃这个批次，写到死信目录
+func (w *sinkWriter) finishNext(cache *Cache, err error) {
+	q := w.retry
+	if err != nil {
+		if !db.IsPermanent(err) && !q.exhausted() {
+			q.backoff()
+			return
+		}
+		log.Printf("放弃写入 %s %s, 次数=%d, 行数=%d, 写到死信目录 %s\n", w.out.name, w.typ, q.retryTimes+1, len(cache.lines), err.Error())
+		q.drop()
+		w.updateOldest()
+		w.out.rejectLines(w.typ, cache.lines)
+		return
+	}
+	q.pop()
+	q.reset()
+	w.updateOldest()
+	w.out.commitLines(cache.lines)
+}
+
+func (w *sinkWriter) updateOldest() {
+	atomic.StoreInt64(&w.oldest, w.retry.oldest())
+}
+
+//等所有写入协程把已经收到的批次写完，在退避中的不等
+func (s *LogSync) flushOutputs() {
+	s.flushBatchers()
+	for _, out := range s.outputs {
+		for _, w := range out.allWriters() {
+			ch := make(chan bool)
+			w.waitChan <- ch
+			<-ch
+		}
+	}
+}
+
+//日志写入一个目标成功后提交这个目标的同步进度，回复确认
+func (out *sinkOutput) commitLines(lines []*tlogLine) {
+	out.finishLines(lines, false)
+}
+
+//放弃写入的日志写到死信目录，同步进度和写入成功一样往后提交，确认为被拒绝
+func (out *sinkOutput) rejectLines(typ string, lines []*tlogLine) {
+	metrics.LinesRejected.WithLabelValues(rejectInsert).Add(float64(len(lines)))
+	for _, line := range lines {
+		if err := out.deadLetter.writeInsert(out.name, typ, line); err != nil {
+			log.Println("写入死信失败", err)
+		}
+	}
+	out.finishLines(lines, true)
+}
+
+func (out *sinkOutput) finishLines(lines []*tlogLine, rejected bool) {
+	files := make(map[*tlogFile]bool)
+	for _, line := range lines {
+		if line.file != nil {
+			line.file.done(out.name, line.offset)
+			files[line.file] = true
+		}
+		if line.ack == nil {
+			continue
+		}
+		if rejected {
+			line.ack.reject()
+		} else {
+			line.ack.commit()
+		}
+	}
+	for f := range files {
+		if err := f.commit(out); err != nil {
+			log.Println("保存同步进度失败", f.path, err)
+		}
+	}
+}
+
+//日志要写入的目标，来自文件的行跳过已经提交过这个位置的目标，重放写入失败的死信时只写入原来失败的目标
+func (s *LogSync) routeOutputs(tline *tlogLine, tlogModel *db.TlogModel) []*sinkOutput {
+	outs := make([]*sinkOutput, 0, len(s.outputs))
+	for _, out := range s.outputs {
+		if !tlogModel.HasSink(out.name) || (len(tline.sink) > 0 && tline.sink != out.name) {
+			continue
+		}
+		if tline.file != nil && tline.file.skipped(out.name, tline.offset) {
+			continue
+		}
+		outs = append(outs, out)
+	}
+	return outs
+}
+
+func (s *LogSync) hasOutput(name string) bool {
+	for _, out := range s.outputs {
+		if out.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+)
+
+//记录每次写入的行数，block不为空时写入等待它关闭
+type testSink struct {
+	name  string
+	block chan bool
+	rows  chan int
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) CreateTable(tlogModel *db.TlogModel, month int) error {
+	return nil
+}
+
+func (s *testSink) AddColumn(tlogModel *db.TlogModel, month int) error {
+	return nil
+}
+
+func (s *testSink) AddIndex(tlogModel *db.TlogModel, month int) error {
+	return nil
+}
+
+func (s *testSink) Insert(tlogModel *db.TlogModel, rows [][]string, sources []string, logtime int64) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.rows <- len(rows)
+	return nil
+}
+
+func newTestOutput(t *testing.T, sink *testSink, retryDir string) *sinkOutput {
+	if len(retryDir) > 0 {
+		if err := os.MkdirAll(retryDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &sinkOutput{
+		name:     sink.name,
+		sink:     sink,
+		retryDir: retryDir,
+		slots:    make(chan bool, 4),
+		writers:  make(map[string]*sinkWriter),
+	}
+}
+
+//一个目标写入很慢时，批次进入它的队列并写到磁盘，另一个目标照常写入
+//没有重试目录的目标队列满了才等待
+func TestSlowSinkNotBlockOthers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Ini.Tlog.BatchWrite = 1
+	config.Ini.Tlog.QueueSize = 1
+	config.Ini.Tlog.SyncTime = 1
+	config.Ini.Tlog.RetryMemory = 4
+	release := make(chan bool)
+	slowSink := &testSink{name: "slow", block: release, rows: make(chan int, 100)}
+	fastSink := &testSink{name: "fast", rows: make(chan int, 100)}
+	s := &LogSync{
+		outputs: []*sinkOutput{
+			newTestOutput(t, slowSink, filepath.Join(dir, "slow")),
+			newTestOutput(t, fastSink, ""),
+		},
+		batchers: make(map[string]*tlogBatcher),
+	}
+	tlogModel := &db.TlogModel{Name: "slowtest", Version: 1}
+	now := time.Now().Unix()
+	total := 20
+	b := s.batcher("slowtest")
+	go func() {
+		for i := 0; i < total; i++ {
+			b.lineChan <- &tlogLine{
+				text:      fmt.Sprintf("slowtest|1|%d|%d", now, i),
+				tlogModel: tlogModel,
+				logtime:   now,
+				outs:      s.outputs,
+			}
+		}
+	}()
+	count := 0
+	timeout := time.After(5 * time.Second)
+	for count < total {
+		select {
+		case n := <-fastSink.rows:
+			count += n
+		case <-timeout:
+			close(release)
+			t.Fatalf("慢的目标写入时另一个目标只写入了%d行，应该是%d行", count, total)
+		}
+	}
+	spilled, err := filepath.Glob(filepath.Join(dir, "slow", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spilled) <= 0 {
+		t.Errorf("慢的目标的批次没有写到磁盘")
+	}
+	close(release)
+	s.stopPipeline()
+}
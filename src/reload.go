@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+)
+
+//重新加载xml，失败的话继续使用旧的xml
+func (s *LogSync) reloadXml() {
+	log.Println("重新加载xml", config.Ini.Tlog.LogXml)
+	if err := db.ReloadModelXml(config.Ini.Tlog.LogXml); err != nil {
+		log.Println("重新加载xml失败", err)
+	}
+}
+
+//监控xml文件变化，编辑器保存时一般会改名替换，所以监控所在的目录
+//调用前shutDownGroup加1
+func (s *LogSync) watchLogXml() {
+	defer s.shutDownGroup.Done()
+	if !config.Ini.Tlog.ReloadXml {
+		return
+	}
+	watch, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("监控xml失败", err)
+		return
+	}
+	xmlPath := filepath.Clean(config.Ini.Tlog.LogXml)
+	if err := watch.Add(filepath.Dir(xmlPath)); err != nil {
+		log.Println("监控xml失败", err)
+		watch.Close()
+		return
+	}
+	log.Println("监控xml", xmlPath)
+	defer func() {
+		log.Println("watch xml done")
+		watch.Close()
+	}()
+	//连续的修改只加载一次
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case ev := <-watch.Events:
+			{
+				if filepath.Clean(ev.Name) != xmlPath {
+					continue
+				}
+				if ev.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+					continue
+				}
+				timer.Reset(time.Second)
+			}
+		case <-timer.C:
+			{
+				s.reloadXml()
+			}
+		case err := <-watch.Errors:
+			{
+				log.Println("error : ", err)
+				return
+			}
+		case <-s.chDie:
+			{
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//写入失败的批次
+type retryBatch struct {
+	typ        string
+	cache      *Cache      //内存中的日志，写到磁盘后为nil
+	spillFile  string      //写到磁盘的文件
+	files      []*tlogFile //写到磁盘后每行的来源文件
+	createTime time.Time
+}
+
+//等待写入和写入失败的批次队列，超过内存上限的写到磁盘，失败后按指数退避重试
+type retryQueue struct {
+	name       string //写入目标
+	typ        string
+	dir        string
+	batches    []*retryBatch
+	memoryLen  int
+	seq        int
+	retryTimes int
+	nextTime   time.Time
+}
+
+//磁盘上保存的批次
+type spillBatch struct {
+	Typ     string      `json:"typ"`
+	Version int32       `json:"version"`
+	Logtime int64       `json:"logtime"`
+	Lines   []spillLine `json:"lines"`
+}
+
+type spillLine struct {
+	Text   string `json:"text"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Source string `json:"source"`
+	Lineno int    `json:"lineno"`
+}
+
+//每种日志一个队列，一个写入目标的队列共用一个目录
+func newRetryQueue(name string, typ string, dir string) *retryQueue {
+	return &retryQueue{
+		name:    name,
+		typ:     typ,
+		dir:     dir,
+		batches: make([]*retryBatch, 0),
+	}
+}
+
+//加载上次退出时写到磁盘的批次，按日志名分到各自的队列
+func loadRetryQueues(name string, dir string) (map[string]*retryQueue, error) {
+	queues := make(map[string]*retryQueue)
+	metrics.RetryBatches.WithLabelValues(name).Set(0)
+	if len(dir) <= 0 {
+		return queues, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".json" {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	for _, filename := range names {
+		spillFile := filepath.Join(dir, filename)
+		cache, typ, err := loadSpillFile(spillFile)
+		if err != nil {
+			log.Println("加载重试批次失败", spillFile, err)
+			continue
+		}
+		//来自文件的行会按同步进度重新读取，只保留其它来源的行
+		//kafka和分帧tcp的行是写到磁盘时已经确认的，来源不会重发
+		lines := make([]*tlogLine, 0)
+		for _, line := range cache.lines {
+			if len(line.path) <= 0 {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) <= 0 {
+			os.Remove(spillFile)
+			continue
+		}
+		cache.lines = lines
+		if err := writeSpillFile(spillFile, typ, cache); err != nil {
+			log.Println("保存重试批次失败", spillFile, err)
+			continue
+		}
+		q, ok := queues[typ]
+		if !ok {
+			q = newRetryQueue(name, typ, dir)
+			queues[typ] = q
+		}
+		q.batches = append(q.batches, &retryBatch{
+			typ:        typ,
+			spillFile:  spillFile,
+			createTime: time.Now(),
+		})
+		q.seq++
+		metrics.RetryBatches.WithLabelValues(name).Inc()
+	}
+	count := 0
+	for _, q := range queues {
+		count += q.len()
+	}
+	log.Printf("加载重试批次 %s, 数量=%d\n", dir, count)
+	return queues, nil
+}
+
+func loadSpillFile(spillFile string) (*Cache, string, error) {
+	bs, err := ioutil.ReadFile(spillFile)
+	if err != nil {
+		return nil, "", err
+	}
+	var batch spillBatch
+	if err := json.Unmarshal(bs, &batch); err != nil {
+		return nil, "", err
+	}
+	tlogModel := db.GetTlogModel(fmt.Sprintf("%sv%d", batch.Typ, batch.Version))
+	if tlogModel == nil {
+		return nil, "", fmt.Errorf("日志版本不存在 %sv%d", batch.Typ, batch.Version)
+	}
+	cache := &Cache{
+		lines:     make([]*tlogLine, 0),
+		logtime:   batch.Logtime,
+		version:   batch.Version,
+		tlogModel: tlogModel,
+	}
+	for _, line := range batch.Lines {
+		cache.push(&tlogLine{
+			text:   line.Text,
+			path:   line.Path,
+			offset: line.Offset,
+			source: line.Source,
+			lineno: line.Lineno,
+		})
+	}
+	return cache, batch.Typ, nil
+}
+
+func writeSpillFile(spillFile string, typ string, cache *Cache) error {
+	batch := spillBatch{
+		Typ:     typ,
+		Version: cache.version,
+		Logtime: cache.logtime,
+		Lines:   make([]spillLine, 0),
+	}
+	for _, line := range cache.lines {
+		batch.Lines = append(batch.Lines, spillLine{
+			Text:   line.text,
+			Path:   line.path,
+			Offset: line.offset,
+			Source: line.source,
+			Lineno: line.lineno,
+		})
+	}
+	bs, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	tmpFilename := spillFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, spillFile)
+}
+
+func (q *retryQueue) len() int {
+	return len(q.batches)
+}
+
+//加入队列，内存满了写到磁盘
+func (q *retryQueue) push(typ string, cache *Cache) {
+	batch := &retryBatch{
+		typ:        typ,
+		cache:      cache,
+		createTime: cache.createTime,
+	}
+	q.batches = append(q.batches, batch)
+	metrics.RetryBatches.WithLabelValues(q.name).Inc()
+	if q.memoryLen < config.Ini.Tlog.RetryMemory || len(q.dir) <= 0 {
+		q.memoryLen++
+		return
+	}
+	if err := q.spill(batch); err != nil {
+		log.Println("重试批次写入磁盘失败", err)
+		q.memoryLen++
+	}
+}
+
+//需要确认的行写到磁盘后就确认，下次启动时从磁盘加载，来源不用重发
+//之后写入成功时不再确认
+func (q *retryQueue) spill(batch *retryBatch) error {
+	spillFile, err := q.writeSpill(batch.typ, batch.cache)
+	if err != nil {
+		return err
+	}
+	batch.files = make([]*tlogFile, 0)
+	for _, line := range batch.cache.lines {
+		batch.files = append(batch.files, line.file)
+		if line.ack != nil {
+			line.ack.commit()
+		}
+	}
+	batch.spillFile = spillFile
+	batch.cache = nil
+	return nil
+}
+
+func (q *retryQueue) writeSpill(typ string, cache *Cache) (string, error) {
+	q.seq++
+	spillFile := filepath.Join(q.dir, fmt.Sprintf("%d_%06d_%s.json", time.Now().UnixNano(), q.seq, typ))
+	return spillFile, writeSpillFile(spillFile, typ, cache)
+}
+
+//退出时把内存中的批次写到磁盘，只写其它地方没有保存的行
+//来自文件的行按同步进度重新读取，kafka、分帧tcp和tcp缓冲的行没有确认，由来源重新发送
+func (q *retryQueue) spillAll() {
+	if len(q.dir) <= 0 {
+		return
+	}
+	for _, batch := range q.batches {
+		if batch.cache == nil {
+			continue
+		}
+		cache := *batch.cache
+		cache.lines = make([]*tlogLine, 0)
+		for _, line := range batch.cache.lines {
+			if len(line.path) <= 0 && line.ack == nil {
+				cache.lines = append(cache.lines, line)
+			}
+		}
+		if len(cache.lines) <= 0 {
+			continue
+		}
+		if _, err := q.writeSpill(batch.typ, &cache); err != nil {
+			log.Println("重试批次写入磁盘失败", err)
+		}
+	}
+}
+
+//队列里最早的日志的读取时间，UnixNano，队列为空返回0
+func (q *retryQueue) oldest() int64 {
+	if len(q.batches) <= 0 {
+		return 0
+	}
+	return q.batches[0].createTime.UnixNano()
+}
+
+//指数退避，从1秒开始，没有配置最大间隔的话最大300秒
+func (q *retryQueue) backoff() {
+	q.retryTimes++
+	interval := time.Second
+	maxInterval := time.Duration(config.Ini.Tlog.RetryMaxInterval) * time.Second
+	if maxInterval <= 0 {
+		maxInterval = 300 * time.Second
+	}
+	for i := 1; i < q.retryTimes && interval < maxInterval; i++ {
+		interval = interval * 2
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+	q.nextTime = time.Now().Add(interval)
+	log.Printf("写入失败 %s %s, 次数=%d, 剩余批次=%d, %s后重试\n", q.name, q.typ, q.retryTimes, len(q.batches), interval)
+}
+
+//加载队列头部的批次，写到磁盘的要重新关联来源文件，确认在写到磁盘时已经回复
+func (q *retryQueue) load(batch *retryBatch) (*Cache, error) {
+	if batch.cache != nil {
+		return batch.cache, nil
+	}
+	cache, _, err := loadSpillFile(batch.spillFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range cache.lines {
+		if i < len(batch.files) {
+			line.file = batch.files[i]
+		}
+	}
+	return cache, nil
+}
+
+//删除队列头部的批次
+func (q *retryQueue) pop() {
+	batch := q.batches[0]
+	if batch.cache != nil {
+		q.memoryLen--
+	} else {
+		os.Remove(batch.spillFile)
+	}
+	q.batches = q.batches[1:]
+	metrics.RetryBatches.WithLabelValues(q.name).Dec()
+}
+
+//这次失败后是否超过最大写入次数
+func (q *retryQueue) exhausted() bool {
+	maxAttempts := config.Ini.Tlog.RetryMaxAttempts
+	return maxAttempts > 0 && q.retryTimes+1 >= maxAttempts
+}
+
+//放弃队列头部的批次，下一个批次重新开始退避
+func (q *retryQueue) drop() {
+	q.pop()
+	q.retryTimes = 0
+	q.nextTime = time.Time{}
+}
+
+//写入成功，结束退避
+func (q *retryQueue) reset() {
+	if q.retryTimes > 0 {
+		log.Println("重试写入成功", q.name, q.typ)
+	}
+	q.retryTimes = 0
+	q.nextTime = time.Time{}
+}
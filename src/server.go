@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/metrics"
 )
 
 func (s *LogSync) listenAndServer() {
@@ -25,29 +26,73 @@ func (s *LogSync) listenAndServer() {
 	}()
 	s.shutDownGroup.Add(1)
 	s.listener = ln
+	go func() {
+		<-s.chDie
+		ln.Close()
+	}()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			log.Println(err)
 			return
 		}
+		s.shutDownGroup.Add(1)
 		go s.handleConnection(conn)
 	}
 }
 
 func (s *LogSync) handleConnection(conn net.Conn) {
+	defer s.shutDownGroup.Done()
+	//退出时断开链接，不再接收日志
+	chQuit := make(chan bool)
+	defer close(chQuit)
+	go func() {
+		select {
+		case <-s.chDie:
+			conn.Close()
+		case <-chQuit:
+		}
+	}()
+	if config.Ini.Tlog.Protocol == "frame" {
+		s.handleFrameConnection(conn)
+		return
+	}
 	log.Println("接受tcp链接")
+	defer conn.Close()
+	metrics.TcpConnections.Inc()
+	defer metrics.TcpConnections.Dec()
+	source := "tcp:" + conn.RemoteAddr().String()
+	lineno := 0
+	limiter := newRateLimiter(config.Ini.Tlog.RateLimit)
 	buff := bufio.NewReader(conn)
 	for {
 		line, err := buff.ReadString('\n')
-		if err == io.EOF {
+		if err != nil && (err != io.EOF || len(line) <= 0) {
 			break
 		}
 		//删掉换行
 		line = strings.Replace(line, "\n", "", 1)
 		//s.syncTlog(line)
 		log.Println(line)
-		s.logChan <- line
+		lineno++
+		//按行的协议没有确认，过载的话等待，不读取新的行，客户端阻塞
+		if !limiter.allow(1) {
+			metrics.TcpOverload.WithLabelValues("ratelimit").Inc()
+			if !limiter.wait(1, s.chDie) {
+				break
+			}
+		}
+		tline := &tlogLine{text: line, source: source, lineno: lineno}
+		if !s.acceptTcp([]*tlogLine{tline}, false) {
+			metrics.TcpOverload.WithLabelValues("full").Inc()
+			if !s.waitAcceptTcp(tline) {
+				break
+			}
+		}
+		//最后一行没有换行
+		if err == io.EOF {
+			break
+		}
 	}
 	log.Println("断开tcp链接")
 }
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+//一个缓冲文件写到这么大后换新的文件
+const spoolFileMaxSize = 64 << 20
+
+var errSpoolFull = errors.New("spool full")
+
+//tcp日志的磁盘缓冲，同步队列满了的时候写到缓冲目录，由重放协程按顺序重新同步
+//每种日志一个缓冲队列，一种日志写入慢不影响其它日志
+type tcpSpool struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64 //全部还没重新同步完的大小
+	queues  map[string]*spoolQueue
+	start   func(q *spoolQueue) //启动重放协程
+}
+
+//一种日志的缓冲，缓冲里还有日志时这种日志新的tcp日志也写到缓冲，保持顺序
+type spoolQueue struct {
+	typ      string
+	size     int64    //还没重新同步完的大小，包括正在重放的文件
+	file     *os.File //正在写入的文件
+	fileSize int64
+	files    []string     //写完等待重放的文件
+	replay   *spoolReplay //正在重放的文件
+	notify   chan bool
+}
+
+//文件名为 时间_日志名.spool，格式和死信相同: 来源\t行号\t原始日志
+func newTcpSpool(dir string, maxSize int64) (*tcpSpool, error) {
+	p := &tcpSpool{
+		dir:     dir,
+		maxSize: maxSize << 20,
+		queues:  make(map[string]*spoolQueue),
+	}
+	if len(dir) <= 0 {
+		return p, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == ".spool" {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	//上次退出时没有重放完的文件
+	for _, name := range names {
+		args := strings.SplitN(strings.TrimSuffix(name, ".spool"), "_", 2)
+		if len(args) != 2 {
+			log.Println("无效tcp缓冲文件", name)
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		q := p.queue(args[1])
+		q.files = append(q.files, filepath.Join(dir, name))
+		q.size += info.Size()
+		p.size += info.Size()
+	}
+	metrics.SpoolBytes.Set(float64(p.size))
+	if len(names) > 0 {
+		log.Println("加载tcp缓冲", len(names), "个文件")
+	}
+	return p, nil
+}
+
+func (p *tcpSpool) enabled() bool {
+	return len(p.dir) > 0
+}
+
+//开始重放，每种日志一个重放协程，之后新的日志第一次写到缓冲时启动
+func (p *tcpSpool) run(start func(q *spoolQueue)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.start = start
+	for _, q := range p.queues {
+		start(q)
+		if len(q.files) > 0 {
+			q.notify <- true
+		}
+	}
+}
+
+//调用前要加锁
+func (p *tcpSpool) queue(typ string) *spoolQueue {
+	if q, ok := p.queues[typ]; ok {
+		return q
+	}
+	q := &spoolQueue{
+		typ:    typ,
+		files:  make([]string, 0),
+		notify: make(chan bool, 1),
+	}
+	p.queues[typ] = q
+	if p.start != nil {
+		p.start(q)
+	}
+	return q
+}
+
+//这种日志的缓冲里还有没重新同步的日志
+func (p *tcpSpool) active(typ string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	q, ok := p.queues[typ]
+	return ok && q.size > 0
+}
+
+//每种日志写到各自的缓冲，全部写入或者全部不写，超过最大大小的话返回errSpoolFull
+//fsync为true时写完同步到磁盘
+func (p *tcpSpool) write(groups map[string][]*tlogLine, fsync bool) error {
+	if !p.enabled() {
+		return errSpoolFull
+	}
+	buffs := make(map[string]*bytes.Buffer)
+	var total int64
+	for typ, lines := range groups {
+		buff := &bytes.Buffer{}
+		for _, line := range lines {
+			fmt.Fprintf(buff, "%s\t%d\t%s\n", line.source, line.lineno, line.text)
+		}
+		buffs[typ] = buff
+		total += int64(buff.Len())
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxSize > 0 && p.size+total > p.maxSize {
+		return errSpoolFull
+	}
+	for typ, buff := range buffs {
+		if err := p.writeQueue(p.queue(typ), buff.Bytes(), fsync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//调用前要加锁
+func (p *tcpSpool) writeQueue(q *spoolQueue, data []byte, fsync bool) error {
+	if q.file == nil {
+		path := filepath.Join(p.dir, fmt.Sprintf("%d_%s.spool", time.Now().UnixNano(), q.typ))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		q.file = file
+		q.fileSize = 0
+	}
+	n, err := q.file.Write(data)
+	q.fileSize += int64(n)
+	q.size += int64(n)
+	p.size += int64(n)
+	metrics.SpoolBytes.Set(float64(p.size))
+	if err != nil {
+		return err
+	}
+	if fsync {
+		if err := q.file.Sync(); err != nil {
+			return err
+		}
+	}
+	if q.fileSize >= spoolFileMaxSize {
+		q.rotate()
+	}
+	select {
+	case q.notify <- true:
+	default:
+	}
+	return nil
+}
+
+//关闭正在写入的文件，交给重放协程，调用前要加锁
+func (q *spoolQueue) rotate() {
+	if q.file == nil {
+		return
+	}
+	q.file.Close()
+	q.files = append(q.files, q.file.Name())
+	q.file = nil
+}
+
+//下一个要重放的文件，没有写完的文件的话把正在写入的文件关闭
+func (p *tcpSpool) next(q *spoolQueue) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(q.files) <= 0 {
+		q.rotate()
+	}
+	if len(q.files) <= 0 {
+		return ""
+	}
+	path := q.files[0]
+	q.files = q.files[1:]
+	return path
+}
+
+func (p *tcpSpool) replaying(q *spoolQueue, r *spoolReplay) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	q.replay = r
+}
+
+//一个文件重放完了，里面的日志都已经写入
+func (p *tcpSpool) done(q *spoolQueue, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	q.replay = nil
+	q.size -= size
+	p.size -= size
+	metrics.SpoolBytes.Set(float64(p.size))
+}
+
+//同步队列停止后调用，这时正在重放的文件里能写入的日志都已经写入
+func (p *tcpSpool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, q := range p.queues {
+		if q.file != nil {
+			q.file.Close()
+			q.file = nil
+		}
+		if q.replay != nil {
+			if err := q.replay.keepRemain(); err != nil {
+				log.Println("保存tcp缓冲失败", q.replay.path, err)
+			}
+			q.replay = nil
+		}
+	}
+}
+
+//tcp日志进入同步队列，缓冲里有这种日志或者队列放不下的话写到缓冲
+//先按日志名检查队列再解析，过载时不解析，客户端重发的日志不会重复写死信和统计
+//写到缓冲的日志已经保存到磁盘，直接确认，重放时再解析，返回false表示过载，日志没有接收
+func (s *LogSync) acceptTcp(lines []*tlogLine, fsync bool) bool {
+	groups := make(map[string][]*tlogLine)
+	for _, line := range lines {
+		typ := tlogType(line.text)
+		groups[typ] = append(groups[typ], line)
+	}
+	spooled := make(map[string][]*tlogLine)
+	for typ, lines := range groups {
+		if s.spool.active(typ) || !s.queueFits(typ, len(lines)) {
+			spooled[typ] = lines
+			delete(groups, typ)
+		}
+	}
+	if len(spooled) > 0 {
+		if err := s.spool.write(spooled, fsync); err != nil {
+			if err != errSpoolFull {
+				log.Println("写入tcp缓冲失败", err)
+			}
+			return false
+		}
+		for _, lines := range spooled {
+			for _, line := range lines {
+				if line.ack != nil {
+					line.ack.commit()
+				}
+			}
+		}
+	}
+	for _, lines := range groups {
+		for _, line := range lines {
+			s.syncTlog(line)
+		}
+	}
+	return true
+}
+
+//按行的协议过载时等待，和没有缓冲时一样让客户端阻塞，不丢弃日志，退出时返回false
+//没有配置缓冲目录的话直接等队列，缓冲满了的话等重放一部分后再试，保持缓冲里的顺序
+func (s *LogSync) waitAcceptTcp(line *tlogLine) bool {
+	if !s.spool.enabled() {
+		s.syncTlog(line)
+		return true
+	}
+	for {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-s.chDie:
+			return false
+		}
+		if s.acceptTcp([]*tlogLine{line}, false) {
+			return true
+		}
+	}
+}
+
+//日志名，还没有检查过，只用来找批次协程和缓冲
+func tlogType(text string) string {
+	return strings.SplitN(strings.TrimSpace(text), "|", 2)[0]
+}
+
+//队列能不能放下这些日志，其它来源同时加入的话可能还要等一会
+//一帧的行数比队列长的话总是写到缓冲
+//还没有批次协程的日志直接解析，不认识的日志名不会用来创建缓冲文件
+func (s *LogSync) queueFits(typ string, n int) bool {
+	s.batchLock.Lock()
+	b, ok := s.batchers[typ]
+	s.batchLock.Unlock()
+	if !ok {
+		return true
+	}
+	return len(b.lineChan)+n <= cap(b.lineChan)
+}
+
+func (s *LogSync) startReplaySpool(q *spoolQueue) {
+	s.shutDownGroup.Add(1)
+	go s.replaySpool(q)
+}
+
+//按顺序重新同步一种日志的缓冲，队列满了的话等待
+func (s *LogSync) replaySpool(q *spoolQueue) {
+	defer s.shutDownGroup.Done()
+	for {
+		select {
+		case <-q.notify:
+			{
+				for path := s.spool.next(q); len(path) > 0; path = s.spool.next(q) {
+					err := s.replaySpoolFile(q, path)
+					if err == errShutDown {
+						return
+					} else if err != nil {
+						log.Println("重放tcp缓冲失败", path, err)
+					}
+				}
+			}
+		case <-s.chDie:
+			{
+				return
+			}
+		}
+	}
+}
+
+//文件里的日志都写入后才删除文件，退出时没有写入的部分在关闭缓冲时保存
+func (s *LogSync) replaySpoolFile(q *spoolQueue, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	log.Println("重放tcp缓冲", path, info.Size())
+	r := newSpoolReplay(path)
+	s.spool.replaying(q, r)
+	buff := bufio.NewReader(file)
+	var offset int64
+	for {
+		select {
+		case <-s.chDie:
+			{
+				return errShutDown
+			}
+		default:
+		}
+		line, err := buff.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		ack := r.add(offset)
+		args := strings.SplitN(strings.TrimRight(line, "\r\n"), "\t", 3)
+		if len(args) != 3 {
+			log.Println("无效tcp缓冲", line)
+			ack.commit()
+			continue
+		}
+		lineno, _ := strconv.Atoi(args[1])
+		s.syncTlog(&tlogLine{
+			text:   args[2],
+			source: args[0],
+			lineno: lineno,
+			ack:    ack,
+		})
+	}
+	r.finishRead()
+	//不用等批次超时
+	s.requestFlush()
+	select {
+	case <-r.chDone:
+	case <-s.chDie:
+		return errShutDown
+	}
+	s.spool.done(q, info.Size())
+	return os.Remove(path)
+}
+
+//正在重放的缓冲文件，记录从头开始已经连续写入到哪里
+type spoolReplay struct {
+	lock      sync.Mutex
+	path      string
+	ends      []int64      //每行结束的位置
+	committed map[int]bool //已经写入，但是前面还有没写入的行
+	next      int          //这行之前的都已经写入
+	read      bool         //文件已经读完
+	chDone    chan bool
+}
+
+func newSpoolReplay(path string) *spoolReplay {
+	return &spoolReplay{
+		path:      path,
+		ends:      make([]int64, 0),
+		committed: make(map[int]bool),
+		chDone:    make(chan bool),
+	}
+}
+
+//增加一行，返回这行的确认，写入所有目标或者被拒绝后确认
+func (r *spoolReplay) add(end int64) *ackGroup {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	index := len(r.ends)
+	r.ends = append(r.ends, end)
+	return &ackGroup{
+		pending: 1,
+		done: func(rejected int) {
+			r.commit(index)
+		},
+	}
+}
+
+func (r *spoolReplay) commit(index int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.committed[index] = true
+	for r.committed[r.next] {
+		delete(r.committed, r.next)
+		r.next++
+	}
+	r.check()
+}
+
+func (r *spoolReplay) finishRead() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.read = true
+	r.check()
+}
+
+//调用前要加锁
+func (r *spoolReplay) check() {
+	if r.read && r.next == len(r.ends) {
+		close(r.chDone)
+	}
+}
+
+//没有写入的行留在文件里，下次启动时继续，已经写入的行去掉
+func (r *spoolReplay) keepRemain() error {
+	select {
+	case <-r.chDone:
+		//退出时才全部写入
+		return os.Remove(r.path)
+	default:
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.next <= 0 && len(r.committed) <= 0 {
+		return nil
+	}
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tmp := r.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	if r.next > 0 {
+		offset = r.ends[r.next-1]
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		out.Close()
+		return err
+	}
+	buff := bufio.NewReader(file)
+	for i := r.next; i < len(r.ends); i++ {
+		w := io.Writer(out)
+		if r.committed[i] {
+			w = ioutil.Discard
+		}
+		if _, err := io.CopyN(w, buff, r.ends[i]-offset); err != nil {
+			out.Close()
+			return err
+		}
+		offset = r.ends[i]
+	}
+	//还没有读取的部分
+	if _, err := io.Copy(out, buff); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+//每个链接的限速，令牌桶，最多积累一秒的令牌
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+//不限速的话返回nil
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+//取n行的令牌，不够的话不取，返回false
+//超过一秒的行数的帧在令牌满的时候可以接收，之后的帧等令牌补回来
+func (l *rateLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	need := float64(n)
+	if need > l.rate {
+		need = l.rate
+	}
+	if l.tokens < need {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+//等到有n行的令牌，按行的协议用，退出时返回false
+func (l *rateLimiter) wait(n int, chDie chan bool) bool {
+	for !l.allow(n) {
+		select {
+		case <-time.After(time.Duration(float64(time.Second) / l.rate)):
+		case <-chDie:
+			return false
+		}
+	}
+	return true
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
@@ -17,36 +15,71 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/shark/minigame-tlogsync/config"
 	"github.com/shark/minigame-tlogsync/db"
+	"github.com/shark/minigame-tlogsync/metrics"
 )
 
 var errLogFormat = errors.New("log format")
 
 type TlogHandler func(logtime int64, typ string, args [][]string) error
 
-type Cache struct {
-	lines     []string
-	logtime   int64
-	version   int32
+//一行日志以及它的来源
+type tlogLine struct {
+	text   string
+	path   string //来源文件，tcp过来的为空
+	offset int64  //在来源文件中的起始位置
+	source string //来源，写死信时用
+	lineno int    //在来源中的行号
+	ack    *ackGroup
+	file   *tlogFile //来源文件，写入成功后提交它的进度
+	sink   string    //只写入这个目标，重放写入失败的死信时用
+
+	//解析后的结果
 	tlogModel *db.TlogModel
+	logtime   int64
+	outs      []*sinkOutput //要写入的目标
+}
+
+type Cache struct {
+	lines      []*tlogLine
+	logtime    int64
+	version    int32
+	tlogModel  *db.TlogModel
+	createTime time.Time
 }
 
 func (c *Cache) len() int {
 	return len(c.lines)
 }
 
-func (c *Cache) push(line string) {
+func (c *Cache) push(line *tlogLine) {
 	c.lines = append(c.lines, line)
 }
 
+//同步分成几个阶段，阶段之间用有长度限制的队列连接，后面的阶段慢的话前面的阶段等待
+//读取和解析: 每个文件、每个链接在自己的协程里读取和解析，同一个来源的日志保持顺序
+//批次缓存: 每种日志一个协程，按写入目标缓存，满了或者超时后交给写入协程
+//写入: 每个目标每种日志一个写入协程，按顺序写入，失败时只有这种日志退避，同时写入的数量有限制
 type LogSync struct {
-	watch    *fsnotify.Watcher
-	fileChan chan string
-	logChan  chan string
-	logCache map[string]*Cache
-	listener net.Listener
+	watch      *fsnotify.Watcher
+	fileChan   chan string
+	readerDone chan *fileReader
+	listener   net.Listener
+
+	outputs    []*sinkOutput
+	readers    map[string]*fileReader //每个路径一个读取协程，只在调度协程里访问
+	readSem    chan bool
+	fileLock   sync.Mutex
+	files      map[uint64]*tlogFile //正在同步的文件按inode索引，改名后的路径等原来的文件写完再接着读
+	batchLock  sync.Mutex
+	batchers   map[string]*tlogBatcher
+	batchGroup sync.WaitGroup
+	deadLetter *deadLetter
+	spool      *tcpSpool
+	udpStat    udpStat
 
 	chDie         chan bool
 	shutDownGroup sync.WaitGroup
+	httpGroup     sync.WaitGroup //正在处理的http请求
 }
 
 func newLogSync() (*LogSync, error) {
@@ -54,33 +87,77 @@ func newLogSync() (*LogSync, error) {
 	if err != nil {
 		return nil, err
 	}
+	deadLetter := newDeadLetter(config.Ini.Tlog.DeadLetterDir)
+	outputs, err := newSinkOutputs(deadLetter)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := newTcpSpool(config.Ini.Tlog.SpoolDir, config.Ini.Tlog.SpoolMaxSize)
+	if err != nil {
+		return nil, err
+	}
 	sync := &LogSync{
-		watch:    watch,
-		fileChan: make(chan string, 1),
-		logChan:  make(chan string, 1),
-		logCache: make(map[string]*Cache),
-		chDie:    make(chan bool),
+		watch:      watch,
+		fileChan:   make(chan string, 1),
+		readerDone: make(chan *fileReader),
+		outputs:    outputs,
+		readers:    make(map[string]*fileReader),
+		readSem:    make(chan bool, maxReadingFiles),
+		files:      make(map[uint64]*tlogFile),
+		batchers:   make(map[string]*tlogBatcher),
+		deadLetter: deadLetter,
+		spool:      spool,
+		chDie:      make(chan bool),
 	}
 	return sync, nil
 }
 
+//每个阶段之间的队列长度
+func queueSize() int {
+	if config.Ini.Tlog.QueueSize > 0 {
+		return config.Ini.Tlog.QueueSize
+	}
+	return 1000
+}
+
 func (s *LogSync) run() {
-	//同步目录里的文件
+	for _, out := range s.outputs {
+		if err := out.checkpoint.prune(); err != nil {
+			log.Println("保存同步进度失败", err)
+		}
+	}
+	//先启动调度协程，目录里的文件交给它分配读取协程
+	s.shutDownGroup.Add(1)
+	go s.forkSync()
 	if err := s.syncDir(config.Ini.Tlog.Dir); err != nil {
 		log.Fatalln(err)
 	}
-	go s.forkSync()
 	//监控文件
 	go s.watchTlogDir()
+	s.shutDownGroup.Add(1)
+	go s.watchLogXml()
 	//开启server
 	go s.listenAndServer()
+	s.spool.run(s.startReplaySpool)
+	s.shutDownGroup.Add(1)
+	go s.listenAndServeHttp()
+	s.shutDownGroup.Add(1)
+	go s.listenUdp()
+	s.shutDownGroup.Add(1)
+	go s.consumeKafka()
+	s.shutDownGroup.Add(1)
+	go s.cleanBackupLoop()
 }
 
 func (s *LogSync) shutDown() {
 	log.Println("shutdown1")
 	close(s.chDie)
 	s.shutDownGroup.Wait()
-	s.flushAllCache()
+	//所有来源都已经停止，把缓存的日志写完，写不进去的保存到重试目录
+	s.stopPipeline()
+	s.closeAllFiles()
+	s.deadLetter.close()
+	s.spool.close()
 	log.Println("shutdown2")
 }
 
@@ -89,7 +166,7 @@ func (s *LogSync) syncDirFunc(path string, info os.FileInfo, err error) error {
 	if info.IsDir() {
 		return nil
 	}
-	s.syncFile(path)
+	s.fileChan <- path
 	return nil
 }
 
@@ -101,10 +178,10 @@ func (s *LogSync) syncDir(dir string) error {
 	return nil
 }
 
-//检查是否日志文件
+//检查是否日志文件，可以是压缩过的 .log.gz .log.zst
 func (s *LogSync) checkTlogFile(path string) bool {
-	name := filepath.Base(path)
-	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), compressExt(path))
+	ext := filepath.Ext(name)
 	if ext != ".log" {
 		return false
 	}
@@ -123,151 +200,213 @@ func (s *LogSync) checkTlogFile(path string) bool {
 	return true
 }
 
-//同步单个文件
-func (s *LogSync) syncFile(path string) error {
-	if !s.checkTlogFile(path) {
-		log.Println("无效文件", path)
-		return nil
+//解析日志，交给这种日志的批次协程，队列满了的话等待
+func (s *LogSync) syncTlog(tline *tlogLine) {
+	if b := s.parseTlog(tline); b != nil {
+		b.lineChan <- tline
 	}
-	log.Println("同步文件", path)
-	file, err := os.Open(path)
-	if nil != err {
-		return err
+}
+
+//队列满了直接丢弃，返回是否加入了队列
+func (s *LogSync) trySyncTlog(tline *tlogLine) bool {
+	b := s.parseTlog(tline)
+	if b == nil {
+		return true
 	}
-	buff := bufio.NewReader(file)
-	for {
-		line, err := buff.ReadString('\n')
-		if err == io.EOF {
-			break
-		}
-		//删掉换行
-		line = strings.TrimSpace(line)
-		s.syncTlog(line)
-	}
-	//批量写入
-	s.flushAllCache()
-	file.Close()
-	//备份文件
-	if err := s.backupFile(path); err != nil {
-		return err
+	select {
+	case b.lineChan <- tline:
+		return true
+	default:
+		return false
 	}
-	return nil
 }
 
-func (s *LogSync) syncTlog(line string) error {
-	line = strings.TrimSpace(line)
-	//log.Println("读取", line)
-	args := strings.Split(line, "|")
-	if len(args) <= 0 {
+//在来源的协程里解析，不需要写入的直接确认，被拒绝的写到死信，返回要交给的批次协程
+func (s *LogSync) parseTlog(tline *tlogLine) *tlogBatcher {
+	//删掉换行
+	line := strings.TrimSpace(tline.text)
+	tline.text = line
+	if len(line) <= 0 {
+		if tline.ack != nil {
+			tline.ack.commit()
+		}
 		return nil
 	}
-	//先加入缓存，一会批量写入
-	typ := args[0]
-	version := atoi32(args[1])
-	logtime := atoi64(args[2])
-	tlogModel := db.GetTlogModel(fmt.Sprintf("%sv%d", typ, version))
-	if tlogModel == nil {
-		log.Printf("过滤日志,请检查xml %s\n", line)
+	//log.Println("读取", line)
+	args, tlogModel, reason, err := checkTlog(line)
+	if err != nil {
+		log.Printf("%s %s\n", err.Error(), line)
+		s.reject(reason, args[0], tline)
 		return nil
 	}
-	if len(args)-1 != len(tlogModel.FieldArr)-2 {
-		log.Printf("日志不符合长度规则 长度要求:%d, %s\n", len(tlogModel.FieldArr)-2, line)
+	metrics.LinesRead.WithLabelValues(args[0], args[1]).Inc()
+	outs := s.routeOutputs(tline, tlogModel)
+	if len(outs) <= 0 {
+		if tline.ack != nil {
+			tline.ack.commit()
+		}
 		return nil
 	}
-	cache, ok := s.logCache[typ]
-	if ok && (!isSameMonth(cache.logtime, logtime) || cache.version != version) {
-		//跨月的话，立刻刷新
-		s.flushCache(typ, cache)
-		delete(s.logCache, typ)
-	}
-	cache, ok = s.logCache[typ]
-	if ok {
-		cache.push(line)
-	} else {
-		cache = &Cache{
-			lines:     make([]string, 0),
-			logtime:   logtime,
-			version:   version,
-			tlogModel: tlogModel,
-		}
-		cache.push(line)
-		s.logCache[typ] = cache
+	tline.tlogModel = tlogModel
+	tline.logtime = atoi64(args[2])
+	tline.outs = outs
+	if tline.ack != nil {
+		//每个目标都写入后才确认
+		tline.ack.add(len(outs) - 1)
 	}
-	if cache.len() >= config.Ini.Tlog.BatchWrite {
-		s.flushCache(typ, cache)
-		delete(s.logCache, typ)
+	if tline.file != nil {
+		tline.file.track(outs, tline)
 	}
-	return nil
+	return s.batcher(args[0])
 }
 
-//换文件时,批量写入所有日志
-func (sync *LogSync) flushAllCache() error {
-	log.Println("刷新全部日志")
-	for typ, cache := range sync.logCache {
-		sync.flushCache(typ, cache)
+//去重的来源，日志文件相对日志目录的路径(去掉压缩扩展名):行号，不同子目录里的同名文件不同
+//文件从备份目录复制回原来的子目录或者压缩过也相同，不在日志目录下的文件只用文件名
+//死信重放的行保留原来的来源，tcp、udp、http、kafka过来的行没有固定的来源，返回空
+func dedupSource(source string, lineno int) string {
+	name := strings.TrimSuffix(source, compressExt(source))
+	if filepath.Ext(name) != ".log" || strings.Contains(source, ":") {
+		return ""
 	}
-	sync.logCache = make(map[string]*Cache)
-	return nil
+	rel, err := filepath.Rel(config.Ini.Tlog.Dir, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(name)
+	}
+	return fmt.Sprintf("%s:%d", filepath.ToSlash(rel), lineno)
 }
 
-//批量写入日志
-func (s *LogSync) flushCache(typ string, cache *Cache) error {
-	//log.Println("刷新日志", typ, s.logCache[typ])
+//检查日志格式，不符合的话返回被拒绝的原因
+func checkTlog(line string) ([]string, *db.TlogModel, string, error) {
+	args := strings.Split(line, "|")
+	if len(args) < 3 {
+		return args, nil, rejectFormat, fmt.Errorf("日志格式错误")
+	}
+	tlogModel := db.GetTlogModel(fmt.Sprintf("%sv%d", args[0], atoi32(args[1])))
+	if tlogModel == nil {
+		return args, nil, rejectUnknown, fmt.Errorf("过滤日志,请检查xml")
+	}
+	if len(args) != len(tlogModel.LineFields())+3 {
+		return args, nil, rejectLength, fmt.Errorf("日志不符合长度规则 长度要求:%d", len(tlogModel.LineFields())+2)
+	}
+	//单独拒绝不符合字段类型的行，不让整批写入失败
+	if err := tlogModel.CheckRow(args); err != nil {
+		return args, nil, rejectField, err
+	}
+	return args, tlogModel, "", nil
+}
+
+//日志目录中等待同步的文件数量
+func (s *LogSync) countPendingFiles() {
+	count := 0
+	filepath.Walk(config.Ini.Tlog.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && s.checkTlogFile(path) {
+			count++
+		}
+		return nil
+	})
+	metrics.PendingFiles.Set(float64(count))
+}
+
+func (out *sinkOutput) writeCache(typ string, cache *Cache) error {
 	rows := make([][]string, 0)
+	sources := make([]string, 0)
 	for _, line := range cache.lines {
-		args := strings.Split(line, "|")
+		args := strings.Split(line.text, "|")
 		if len(args) <= 0 {
-			log.Println("无效日志", line)
+			log.Println("无效日志", line.text)
 			return nil
 		}
 		//log.Println("写入日志", line)
 		rows = append(rows, args)
+		sources = append(sources, dedupSource(line.source, line.lineno))
 	}
-	if err := s.tlogCommon(cache.tlogModel, typ, rows, cache.logtime); err != nil {
+	if err := out.tlogCommon(cache.tlogModel, typ, rows, sources, cache.logtime); err != nil {
+		metrics.InsertErrors.WithLabelValues(out.name, typ).Inc()
 		return err
 	}
 	return nil
 }
 
-//备份文件
-func (s *LogSync) backupFile(path string) error {
-	//return nil
-	backupPath := strings.Replace(path, config.Ini.Tlog.Dir, config.Ini.Tlog.BackupDir, 1)
-	log.Println("备份文件", path, "=>", backupPath)
-	dir := filepath.Dir(backupPath)
-	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
-		if err := os.Mkdir(dir, 0666); err != nil {
-			return nil
+//提交文件在所有目标的同步进度
+func (s *LogSync) commitFileAll(f *tlogFile) error {
+	for _, out := range s.outputs {
+		if err := f.commit(out); err != nil {
+			return err
 		}
 	}
-	if err := os.Rename(path, backupPath); err != nil {
-		return nil
-	}
 	return nil
 }
 
-//监听文件变化
+func (s *LogSync) removeCheckpoint(path string) {
+	for _, out := range s.outputs {
+		if err := out.checkpoint.remove(path); err != nil {
+			log.Println("保存同步进度失败", path, err)
+		}
+	}
+}
+
+//备份文件，按备份日期分目录，可以压缩
+func (s *LogSync) backupFile(path string) error {
+	if config.Ini.Tlog.Archive == "parquet" {
+		return s.archiveFile(path)
+	}
+	rel, err := filepath.Rel(config.Ini.Tlog.Dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+	backupPath := filepath.Join(config.Ini.Tlog.BackupDir, time.Now().Format("2006-01-02"), rel)
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return err
+	}
+	compress := config.Ini.Tlog.BackupCompress
+	if len(compressExt(path)) > 0 {
+		//已经压缩过的文件直接移动
+		compress = ""
+	}
+	switch compress {
+	case "gzip":
+		backupPath = backupPath + ".gz"
+	case "zstd":
+		backupPath = backupPath + ".zst"
+	default:
+		log.Println("备份文件", path, "=>", backupPath)
+		return os.Rename(path, backupPath)
+	}
+	log.Println("压缩备份文件", path, "=>", backupPath)
+	if err := compressFile(path, backupPath, compress); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+//调度协程，给每个文件分配读取协程
 func (s *LogSync) forkSync() {
 	tick := time.NewTicker(time.Duration(config.Ini.Tlog.SyncTime) * time.Second)
+	metricTick := time.NewTicker(time.Second)
 	defer func() {
 		log.Println("sync done")
 		tick.Stop()
+		metricTick.Stop()
 		s.shutDownGroup.Done()
 	}()
-	s.shutDownGroup.Add(1)
 	for {
 		select {
 		case path := <-s.fileChan:
 			{
-				s.syncFile(path)
+				s.dispatchFile(path)
 			}
-		case line := <-s.logChan:
+		case r := <-s.readerDone:
 			{
-				s.syncTlog(line)
+				s.removeReader(r)
 			}
 		case <-tick.C:
 			{
-				s.flushAllCache()
+				s.logUdpStat()
+				s.countPendingFiles()
+			}
+		case <-metricTick.C:
+			{
+				s.updateOldestUnflushed()
 			}
 		case <-s.chDie:
 			{
@@ -277,9 +416,13 @@ func (s *LogSync) forkSync() {
 	}
 }
 
-func (s *LogSync) tlogCommon(tlogModel *db.TlogModel, typ string, lines [][]string, logtime int64) error {
-	if err := db.Common_Insert(tlogModel, typ, lines, logtime); err != nil {
+func (out *sinkOutput) tlogCommon(tlogModel *db.TlogModel, typ string, lines [][]string, sources []string, logtime int64) error {
+	startTime := time.Now()
+	err := out.sink.Insert(tlogModel, lines, sources, logtime)
+	metrics.InsertDuration.WithLabelValues(out.name, typ).Observe(time.Since(startTime).Seconds())
+	if err != nil {
 		return err
 	}
+	metrics.RowsInserted.WithLabelValues(out.name, typ).Add(float64(len(lines)))
 	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/db"
+)
+
+const testXml = `<?xml version="1.0" encoding="UTF-8"?>
+<xml>
+    <tlog name="login" version="1" comment="登录" sharding="month" dedup="source">
+        <field name="gameid"   type="int(11)"     comment="游戏id"/>
+        <field name="userid"   type="bigint"      comment="用户id"/>
+        <field name="ip"       type="varchar(32)" comment="ip"/>
+    </tlog>
+</xml>
+`
+
+//日志文件经过读取、批次、写入协程写到sqlite，格式错误的行写到死信目录
+//按来源去重，不同子目录里的同名文件都写入
+func TestSyncFileToSqlite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlogsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	ini := fmt.Sprintf(`[sqlite]
+file=%s
+[tlog]
+dir=%s
+backupdir=%s
+archive=rename
+batchwrite=100
+writers=1
+queuesize=100
+synctime=1
+spooldir=
+logxml=%s
+sink=sqlite
+reloadxml=false
+autocreatetable=true
+autoaddcolumn=true
+checkpoint=%s
+retrydir=%s
+retrymemory=10
+retrymaxinterval=1
+deadletterdir=%s
+`, path("tlog.db"), path("tlog"), path("tlogbak"), path("tlog.xml"), path("tlog.checkpoint"), path("tlogretry"), path("tlogdead"))
+	if err := ioutil.WriteFile(path("config.ini"), []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path("tlog.xml"), []byte(testXml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	lines := []string{
+		fmt.Sprintf("login|1|%d|1|10001|127.0.0.1", now),
+		fmt.Sprintf("login|1|%d|1|10002|127.0.0.2", now),
+		fmt.Sprintf("login|1|%d|1|abc|127.0.0.3", now),
+		fmt.Sprintf("login|1|%d|2|10003|127.0.0.4", now),
+	}
+	//两个子目录里的同名文件，按来源去重时不是重复的行
+	for _, sub := range []string{"server1", "server2"} {
+		if err := os.MkdirAll(path("tlog/"+sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path("tlog/"+sub+"/svc_tlog_2021010100.log"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := config.Load(path("config.ini")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db.SyncDatabase()
+	s, err := newLogSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.run()
+
+	conn, err := sql.Open("sqlite3", path("tlog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	month := time.Unix(now, 0).Format("200601")
+	count := 0
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if err := conn.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM login_%s", month)).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count >= 6 {
+			break
+		}
+	}
+	s.shutDown()
+	if count != 6 {
+		t.Fatalf("写入%d行，应该是6行", count)
+	}
+	var userids []int64
+	rows, err := conn.Query(fmt.Sprintf("SELECT userid FROM login_%s ORDER BY userid", month))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userid int64
+		if err := rows.Scan(&userid); err != nil {
+			t.Fatal(err)
+		}
+		userids = append(userids, userid)
+	}
+	if fmt.Sprint(userids) != "[10001 10001 10002 10002 10003 10003]" {
+		t.Fatalf("写入的userid %v", userids)
+	}
+	dead, err := filepath.Glob(path("tlogdead/*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 {
+		t.Fatalf("死信文件 %v", dead)
+	}
+}
+
+//去重的来源是相对日志目录的路径和行号
+func TestDedupSource(t *testing.T) {
+	config.Ini.Tlog.Dir = "./tlog"
+	tests := []struct {
+		source string
+		lineno int
+		expect string
+	}{
+		{"tlog/svc_tlog_2021010100.log", 3, "svc_tlog_2021010100.log:3"},
+		{"./tlog/svc_tlog_2021010100.log.gz", 3, "svc_tlog_2021010100.log:3"},
+		{"tlog/server1/svc_tlog_2021010100.log", 3, "server1/svc_tlog_2021010100.log:3"},
+		{"tlog/server2/svc_tlog_2021010100.log.zst", 3, "server2/svc_tlog_2021010100.log:3"},
+		{"/data/other/svc_tlog_2021010100.log", 3, "svc_tlog_2021010100.log:3"},
+		{"tcp:127.0.0.1:5000", 3, ""},
+		{"tlog/svc_tlog_2021010100.txt", 3, ""},
+	}
+	for _, test := range tests {
+		if key := dedupSource(test.source, test.lineno); key != test.expect {
+			t.Errorf("%s:%d 的来源是 %s，应该是 %s", test.source, test.lineno, key, test.expect)
+		}
+	}
+}
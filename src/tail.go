@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shark/minigame-tlogsync/config"
+)
+
+var errShutDown = errors.New("shut down")
+
+//同时读取的文件数量，积压很多文件时不会同时打开
+const maxReadingFiles = 16
+
+//一个路径的读取协程，文件被轮转后接着读新的文件
+type fileReader struct {
+	path     string
+	f        *tlogFile
+	events   chan bool //有新的写入，还没处理的合并成一个
+	doneChan chan bool //关闭的文件所有目标都写入成功
+}
+
+//正在同步的文件，由读取协程读取，写入协程写入成功后提交进度
+type tlogFile struct {
+	path       string
+	inode      uint64
+	skip       map[string]int64 //每个目标已经提交的位置，之前的行不再写入这个目标，打开后不再修改
+	compress   string           //压缩格式 gzip zstd，位置是解压后的位置
+	file       *os.File         //读完后关闭，等待写入时为nil
+	activeTime time.Time        //最后读到数据的时间
+	notify     chan bool
+	drainChan  chan bool //读完并且所有目标都写入后关闭，又有新内容时重新创建
+
+	lock     sync.Mutex
+	offset   int64                     //已读取的位置
+	lineno   int                       //已读取的行号
+	pending  map[string][]*tlogLine    //每个目标还没写入的行，按位置排序
+	written  map[string]map[int64]bool //每个目标已经写入，但是前面还有没写入的行
+	closed   bool                      //已经读完，等待所有目标写入后备份
+	detached bool                      //文件被轮转或者截断，不再提交进度
+}
+
+//交给这个路径的读取协程，还没有的话启动一个
+func (s *LogSync) dispatchFile(path string) {
+	r, ok := s.readers[path]
+	if !ok {
+		if !s.checkTlogFile(path) {
+			log.Println("无效文件", path)
+			return
+		}
+		r = &fileReader{
+			path:     path,
+			events:   make(chan bool, 1),
+			doneChan: make(chan bool, 1),
+		}
+		s.readers[path] = r
+		s.shutDownGroup.Add(1)
+		go s.readLoop(r)
+	}
+	select {
+	case r.events <- true:
+	default:
+	}
+}
+
+//读取协程退出后删除，退出前又有新的写入的话重新启动
+func (s *LogSync) removeReader(r *fileReader) {
+	delete(s.readers, r.path)
+	if len(r.events) > 0 {
+		s.dispatchFile(r.path)
+	}
+}
+
+//同一个路径的文件在一个协程里按顺序读取，不同的文件同时读取
+func (s *LogSync) readLoop(r *fileReader) {
+	defer s.shutDownGroup.Done()
+	var idle <-chan time.Time
+	if config.Ini.Tlog.Tail {
+		tick := time.NewTicker(time.Duration(config.Ini.Tlog.SyncTime) * time.Second)
+		defer tick.Stop()
+		idle = tick.C
+	}
+	for {
+		select {
+		case <-r.events:
+			{
+				if err := s.syncFile(r); err != nil && err != errShutDown {
+					log.Println("同步文件失败", r.path, err)
+				}
+			}
+		case <-r.doneChan:
+			{
+				s.finishFile(r)
+			}
+		case <-idle:
+			{
+				s.closeIdleFile(r)
+			}
+		case <-s.chDie:
+			{
+				return
+			}
+		}
+		if r.f == nil {
+			//没有要同步的文件了，让调度协程删除这个读取协程
+			select {
+			case s.readerDone <- r:
+			case <-s.chDie:
+			}
+			return
+		}
+	}
+}
+
+//同步单个文件
+func (s *LogSync) syncFile(r *fileReader) error {
+	if err := s.waitRenamedFile(r); err != nil {
+		return err
+	}
+	select {
+	case s.readSem <- true:
+	case <-s.chDie:
+		return errShutDown
+	}
+	defer func() {
+		<-s.readSem
+	}()
+	restart := false
+	if f := r.f; f != nil && s.isRotated(f) {
+		//文件被改名或者删除，读完剩下的内容
+		log.Println("文件被轮转", r.path)
+		r.f = nil
+		err := s.closeFile(f, false)
+		f.detach()
+		if err != nil {
+			return err
+		}
+	} else if f != nil && s.isTruncated(f) {
+		log.Println("文件被截断,从头同步", r.path)
+		r.f = nil
+		if f.file != nil {
+			f.file.Close()
+		}
+		f.detach()
+		restart = true
+	}
+	if r.f == nil {
+		if _, err := os.Stat(r.path); err != nil && os.IsNotExist(err) {
+			return nil
+		}
+		log.Println("同步文件", r.path)
+		f, err := s.openFile(r.path, r.doneChan, restart)
+		if err != nil {
+			return err
+		}
+		r.f = f
+	} else if r.f.file == nil {
+		//等待写入的文件又有新内容，接着读
+		if err := r.f.reopen(); err != nil {
+			return err
+		}
+	}
+	if err := s.readFile(r.f, false); err != nil {
+		return err
+	}
+	if config.Ini.Tlog.Tail && len(r.f.compress) <= 0 {
+		//跟踪模式下文件空闲一段时间后才结束，压缩过的文件已经写完了
+		return nil
+	}
+	return s.closeFile(r.f, true)
+}
+
+//打开文件，从上次提交的位置开始读，restart的话从头读
+func (s *LogSync) openFile(path string, notify chan bool, restart bool) (*tlogFile, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	inode := fileInode(info)
+	compress := compressName(path)
+	//从每个目标上次提交的位置中最小的继续，已经提交过的行不再写入这个目标
+	skip := make(map[string]int64)
+	offset, lineno := int64(-1), 0
+	for _, out := range s.outputs {
+		outOffset, outLineno := out.checkpoint.get(path, inode)
+		skip[out.name] = outOffset
+		if offset < 0 || outOffset < offset {
+			offset = outOffset
+			lineno = outLineno
+		}
+	}
+	truncated := false
+	for _, outOffset := range skip {
+		if outOffset > info.Size() && len(compress) <= 0 {
+			truncated = true
+		}
+	}
+	if restart || truncated || offset < 0 {
+		if truncated {
+			log.Println("文件被截断,从头同步", path)
+		}
+		skip = make(map[string]int64)
+		offset = 0
+		lineno = 0
+	}
+	if prev := s.takeRenamedFile(path, inode); prev != nil {
+		//改名前读到的行都已经写入，提交的进度可能还没跟上
+		prevOffset, prevLineno := prev.progress()
+		if prevOffset > offset && (prevOffset <= info.Size() || len(compress) > 0) {
+			offset = prevOffset
+			lineno = prevLineno
+			for name := range skip {
+				if skip[name] < offset {
+					skip[name] = offset
+				}
+			}
+		}
+	}
+	if offset > 0 {
+		log.Println("继续同步文件", path, "offset", offset)
+	}
+	f := &tlogFile{
+		path:       path,
+		inode:      inode,
+		offset:     offset,
+		lineno:     lineno,
+		skip:       skip,
+		compress:   compress,
+		file:       file,
+		activeTime: info.ModTime(),
+		notify:     notify,
+		drainChan:  make(chan bool),
+		pending:    make(map[string][]*tlogLine),
+		written:    make(map[string]map[int64]bool),
+	}
+	s.addFile(f)
+	return f, nil
+}
+
+//文件被改名成另一个要同步的文件，原来的文件可能还有读取了没写入的行，按inode找到后等它们写入，
+//不然新路径从提交的进度开始读会重复写入，不占用读取的名额，原来的文件要读取协程检查到改名后才结束
+func (s *LogSync) waitRenamedFile(r *fileReader) error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil
+	}
+	inode := fileInode(info)
+	if inode == 0 || (r.f != nil && r.f.inode == inode) {
+		return nil
+	}
+	s.fileLock.Lock()
+	prev, ok := s.files[inode]
+	s.fileLock.Unlock()
+	if !ok || prev.path == r.path {
+		return nil
+	}
+	for {
+		drainChan, drained := prev.drainState()
+		if drained {
+			return nil
+		}
+		log.Println("等待改名前的文件写入", prev.path, "=>", r.path)
+		select {
+		case <-drainChan:
+		case <-s.chDie:
+			return errShutDown
+		}
+	}
+}
+
+//改名前的文件已经都写入的话交给新路径，不再提交原来路径的进度
+func (s *LogSync) takeRenamedFile(path string, inode uint64) *tlogFile {
+	if inode == 0 {
+		return nil
+	}
+	s.fileLock.Lock()
+	prev, ok := s.files[inode]
+	s.fileLock.Unlock()
+	if !ok || prev.path == path {
+		return nil
+	}
+	if _, drained := prev.drainState(); !drained {
+		log.Println("改名前的文件还没有写完", prev.path, "=>", path)
+		return nil
+	}
+	prev.detach()
+	return prev
+}
+
+//记录正在同步的文件，顺便删除已经轮转并且都写入的文件
+func (s *LogSync) addFile(f *tlogFile) {
+	if f.inode == 0 {
+		return
+	}
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	for inode, old := range s.files {
+		if _, drained := old.drainState(); drained && old.isDetached() {
+			delete(s.files, inode)
+		}
+	}
+	s.files[f.inode] = f
+}
+
+//文件备份后不再同步
+func (s *LogSync) removeFile(f *tlogFile) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	if s.files[f.inode] == f {
+		delete(s.files, f.inode)
+	}
+}
+
+//读取新写入的完整行，最后一行没写完的话下次再读
+func (s *LogSync) readFile(f *tlogFile, final bool) error {
+	if len(f.compress) > 0 {
+		return s.readCompressFile(f)
+	}
+	if _, err := f.file.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	return s.readLines(f, bufio.NewReader(f.file), final)
+}
+
+//压缩文件不能随机读，从头解压并跳过已经读取的部分，压缩文件是写完的，最后一行没有换行也读取
+func (s *LogSync) readCompressFile(f *tlogFile) error {
+	if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r, err := newDecompressReader(f.file, f.compress)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	buff := bufio.NewReader(r)
+	if _, err := io.CopyN(ioutil.Discard, buff, f.offset); err != nil {
+		return err
+	}
+	return s.readLines(f, buff, true)
+}
+
+//在读取协程里解析，交给批次协程的队列满了的话等待
+func (s *LogSync) readLines(f *tlogFile, buff *bufio.Reader, final bool) error {
+	for {
+		select {
+		case <-s.chDie:
+			//退出时不再读取，已经读取的行写入后提交进度
+			return errShutDown
+		default:
+		}
+		line, err := buff.ReadString('\n')
+		if err == io.EOF {
+			if !final || len(strings.TrimSpace(line)) <= 0 {
+				break
+			}
+		} else if err != nil {
+			return err
+		}
+		f.activeTime = time.Now()
+		s.syncTlog(&tlogLine{
+			text:   line,
+			path:   f.path,
+			offset: f.offset,
+			source: f.path,
+			lineno: f.lineno + 1,
+			file:   f,
+		})
+		f.advance(int64(len(line)))
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+//读完剩下的内容并关闭文件，所有目标都写入成功后由读取协程备份
+func (s *LogSync) closeFile(f *tlogFile, backup bool) error {
+	if f.file != nil {
+		err := s.readFile(f, true)
+		f.file.Close()
+		f.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	//批量写入
+	s.flushBatchers()
+	if err := s.commitFileAll(f); err != nil {
+		return err
+	}
+	if !backup {
+		return nil
+	}
+	if !f.close() {
+		log.Println("等待所有目标写入成功后备份", f.path)
+	}
+	return nil
+}
+
+//关闭的文件所有目标都写入成功，备份文件
+func (s *LogSync) finishFile(r *fileReader) {
+	f := r.f
+	if f == nil || f.file != nil || !f.drained() {
+		return
+	}
+	r.f = nil
+	s.removeFile(f)
+	if err := s.backupFile(f.path); err != nil {
+		log.Println("备份文件失败", f.path, err)
+		return
+	}
+	s.removeCheckpoint(f.path)
+}
+
+//文件被改名或者删除
+func (s *LogSync) isRotated(f *tlogFile) bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return true
+	}
+	return fileInode(info) != f.inode
+}
+
+//文件被截断，压缩文件不会被截断
+func (s *LogSync) isTruncated(f *tlogFile) bool {
+	if len(f.compress) > 0 {
+		return false
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	return info.Size() < f.offset
+}
+
+//关闭长时间没有写入的文件
+func (s *LogSync) closeIdleFile(r *fileReader) {
+	f := r.f
+	if f == nil || f.file == nil {
+		return
+	}
+	idleTime := time.Duration(config.Ini.Tlog.IdleTime) * time.Second
+	if time.Since(f.activeTime) < idleTime {
+		return
+	}
+	log.Println("文件空闲,结束同步", f.path)
+	if err := s.closeFile(f, true); err != nil && err != errShutDown {
+		log.Println("同步文件失败", f.path, err)
+	}
+}
+
+//退出时保存进度，不备份，调用前读取协程和写入协程都要已经退出
+func (s *LogSync) closeAllFiles() {
+	for path, r := range s.readers {
+		if f := r.f; f != nil {
+			if err := s.commitFileAll(f); err != nil {
+				log.Println("保存同步进度失败", f.path, err)
+			}
+			if f.file != nil {
+				f.file.Close()
+			}
+		}
+		delete(s.readers, path)
+	}
+}
+
+//记录要写入的目标，写入成功前不能提交这一行之后的位置
+func (f *tlogFile) track(outs []*sinkOutput, line *tlogLine) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, out := range outs {
+		f.pending[out.name] = append(f.pending[out.name], line)
+	}
+}
+
+//这个目标是否已经提交过这个位置
+func (f *tlogFile) skipped(name string, offset int64) bool {
+	return offset < f.skip[name]
+}
+
+//读取了一行
+func (f *tlogFile) advance(n int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.offset += n
+	f.lineno++
+}
+
+//一行写入了一个目标，从头开始连续写入的行都不再等待
+func (f *tlogFile) done(name string, offset int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	written, ok := f.written[name]
+	if !ok {
+		written = make(map[int64]bool)
+		f.written[name] = written
+	}
+	written[offset] = true
+	lines := f.pending[name]
+	for len(lines) > 0 && written[lines[0].offset] {
+		delete(written, lines[0].offset)
+		lines = lines[1:]
+	}
+	f.pending[name] = lines
+	if f.isDrained() {
+		f.notifyDone()
+	}
+}
+
+//提交文件在一个目标的同步进度，还没写入的行之后的位置不能提交
+func (f *tlogFile) commit(out *sinkOutput) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.detached {
+		return nil
+	}
+	offset := f.offset
+	lineno := f.lineno
+	if lines := f.pending[out.name]; len(lines) > 0 && lines[0].offset < offset {
+		offset = lines[0].offset
+		lineno = lines[0].lineno - 1
+	}
+	if offset < f.skip[out.name] {
+		//还没读到这个目标上次提交的位置
+		return nil
+	}
+	return out.checkpoint.commit(f.path, f.inode, offset, lineno)
+}
+
+//读完了，所有目标都写入后通知读取协程，已经都写入的话返回true
+func (f *tlogFile) close() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	if f.isDrained() {
+		f.notifyDone()
+		return true
+	}
+	return false
+}
+
+//等待写入的文件又有新内容，重新打开接着读
+func (f *tlogFile) reopen() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.activeTime = time.Now()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = false
+	select {
+	case <-f.drainChan:
+		f.drainChan = make(chan bool)
+	default:
+	}
+	return nil
+}
+
+func (f *tlogFile) drained() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.isDrained()
+}
+
+//文件被轮转或者截断后不再读取，剩下的行写入后不再提交进度，新的文件从自己的进度继续
+func (f *tlogFile) detach() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.detached = true
+	f.closed = true
+	if f.isDrained() {
+		f.notifyDone()
+	}
+}
+
+func (f *tlogFile) isDetached() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.detached
+}
+
+//已读取的位置和行号
+func (f *tlogFile) progress() (int64, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.offset, f.lineno
+}
+
+//是否已经都写入，没有的话返回写入后关闭的chan
+func (f *tlogFile) drainState() (chan bool, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.drainChan, f.isDrained()
+}
+
+//调用前要加锁
+func (f *tlogFile) isDrained() bool {
+	if !f.closed {
+		return false
+	}
+	for _, lines := range f.pending {
+		if len(lines) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//调用前要加锁
+func (f *tlogFile) notifyDone() {
+	select {
+	case <-f.drainChan:
+	default:
+		close(f.drainChan)
+	}
+	select {
+	case f.notify <- true:
+	default:
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/shark/minigame-tlogsync/config"
+	"github.com/shark/minigame-tlogsync/metrics"
+)
+
+const udpMaxPacketSize = 65535
+
+//udp统计
+type udpStat struct {
+	packets   int64 //收到的包
+	malformed int64 //格式错误的包
+	dropped   int64 //队列满了丢弃的行
+}
+
+//调用前shutDownGroup加1，关闭监听后才减1，之后才能关闭同步队列
+func (s *LogSync) listenUdp() {
+	defer s.shutDownGroup.Done()
+	if len(config.Ini.Tlog.UdpListen) <= 0 {
+		return
+	}
+	conn, err := net.ListenPacket("udp", config.Ini.Tlog.UdpListen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("监听udp", config.Ini.Tlog.UdpListen, "syslog", config.Ini.Tlog.UdpSyslog)
+	metrics.RegisterUdp(&s.udpStat.packets, &s.udpStat.malformed, &s.udpStat.dropped)
+	defer log.Println("udp done")
+	go func() {
+		<-s.chDie
+		conn.Close()
+	}()
+	buff := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		atomic.AddInt64(&s.udpStat.packets, 1)
+		payload := string(buff[:n])
+		if config.Ini.Tlog.UdpSyslog {
+			if payload, err = parseSyslog(payload); err != nil {
+				atomic.AddInt64(&s.udpStat.malformed, 1)
+				log.Println("syslog格式错误", addr, err)
+				continue
+			}
+		}
+		source := "udp:" + addr.String()
+		for _, line := range strings.Split(payload, "\n") {
+			if len(strings.TrimSpace(line)) <= 0 {
+				continue
+			}
+			//不等待，队列满了直接丢弃
+			if !s.trySyncTlog(&tlogLine{text: line, source: source}) {
+				atomic.AddInt64(&s.udpStat.dropped, 1)
+			}
+		}
+	}
+}
+
+func (s *LogSync) logUdpStat() {
+	if len(config.Ini.Tlog.UdpListen) <= 0 {
+		return
+	}
+	log.Printf("udp统计 收到=%d 格式错误=%d 丢弃=%d\n",
+		atomic.LoadInt64(&s.udpStat.packets), atomic.LoadInt64(&s.udpStat.malformed), atomic.LoadInt64(&s.udpStat.dropped))
+}
+
+//取出RFC 5424格式syslog的MSG部分
+//<PRI>VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseSyslog(packet string) (string, error) {
+	if !strings.HasPrefix(packet, "<") {
+		return "", fmt.Errorf("缺少PRI")
+	}
+	end := strings.IndexByte(packet, '>')
+	if end < 2 || end > 4 {
+		return "", fmt.Errorf("PRI错误")
+	}
+	//facility*8+severity，最大23*8+7
+	if pri, err := strconv.ParseUint(packet[1:end], 10, 8); err != nil || pri > 191 {
+		return "", fmt.Errorf("PRI错误")
+	}
+	rest := packet[end+1:]
+	//VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	for i := 0; i < 6; i++ {
+		pos := strings.IndexByte(rest, ' ')
+		if pos <= 0 {
+			return "", fmt.Errorf("头部字段不足")
+		}
+		if i == 0 {
+			if version, err := strconv.ParseUint(rest[:pos], 10, 16); err != nil || version <= 0 {
+				return "", fmt.Errorf("VERSION错误")
+			}
+		}
+		rest = rest[pos+1:]
+	}
+	//STRUCTURED-DATA
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		for strings.HasPrefix(rest, "[") {
+			pos, err := syslogElementEnd(rest)
+			if err != nil {
+				return "", err
+			}
+			rest = rest[pos+1:]
+		}
+	}
+	if len(rest) <= 0 {
+		return "", nil
+	}
+	if rest[0] != ' ' {
+		return "", fmt.Errorf("STRUCTURED-DATA错误")
+	}
+	msg := []byte(rest[1:])
+	msg = bytes.TrimPrefix(msg, []byte("\xEF\xBB\xBF"))
+	return string(msg), nil
+}
+
+//SD-ELEMENT结束的位置，引号里的\]不算
+func syslogElementEnd(s string) (int, error) {
+	inQuote := false
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuote = !inQuote
+		case ']':
+			if !inQuote {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("STRUCTURED-DATA没有结束")
+}
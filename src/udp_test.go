@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	cases := []struct {
+		packet string
+		msg    string
+		ok     bool
+	}{
+		{"<134>1 2021-01-15T00:00:00Z host app 123 tlog - pay|1|1610668800|7", "pay|1|1610668800|7", true},
+		{"<0>1 - - - - - - pay|1", "pay|1", true},
+		{"<191>12 - - - - - - pay|1", "pay|1", true},
+		//NILVALUE，没有MSG
+		{"<134>1 - - - - - -", "", true},
+		{"<134>1 - - - - - - ", "", true},
+		//MSG里的空格和-保留
+		{"<134>1 - - - - - - - a b|", "- a b|", true},
+		//STRUCTURED-DATA，引号里的]和\]不算结束
+		{`<134>1 - host app - - [id@32473 a="1" b="x]y"] pay|1`, "pay|1", true},
+		{`<134>1 - host app - - [id@32473 a="x\]y"][meta seq="2"] pay|1`, "pay|1", true},
+		{`<134>1 - host app - - [id@32473 a="x\"]y"] pay|1`, "pay|1", true},
+		{`<134>1 - host app - - [id@32473 a="1"]`, "", true},
+		{`<134>1 - host app - - [id@32473 a="1" pay|1`, "", false},
+		{`<134>1 - host app - - [id@32473 a="1"]pay|1`, "", false},
+		//BOM
+		{"<134>1 - - - - - - \xEF\xBB\xBFpay|1", "pay|1", true},
+		{"<134>1 - - - - - [id a=\"1\"] \xEF\xBB\xBFpay|1", "pay|1", true},
+		//PRI和VERSION错误
+		{"134>1 - - - - - - pay|1", "", false},
+		{"<>1 - - - - - - pay|1", "", false},
+		{"<1912>1 - - - - - - pay|1", "", false},
+		{"<192>1 - - - - - - pay|1", "", false},
+		{"<ab>1 - - - - - - pay|1", "", false},
+		{"<-1>1 - - - - - - pay|1", "", false},
+		{"<134>0 - - - - - - pay|1", "", false},
+		{"<134>x - - - - - - pay|1", "", false},
+		//RFC 3164格式或者头部字段不足
+		{"<134>Jan 15 00:00:00 host app: pay|1", "", false},
+		{"<134>1 - - - -", "", false},
+		{"<134>1  - - - - - pay|1", "", false},
+		{"<134>1 - - - - - -pay|1", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		msg, err := parseSyslog(c.packet)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%q 应该格式错误，解析出了 %q", c.packet, msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q 解析失败 %v", c.packet, err)
+			continue
+		}
+		if msg != c.msg {
+			t.Errorf("%q 解析出了 %q，应该是 %q", c.packet, msg, c.msg)
+		}
+	}
+}
@@ -10,6 +10,13 @@ import (
 )
 
 func (s *LogSync) watchTlogDirFunc(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		//遍历时文件被备份或者删除了
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
 	if !info.IsDir() {
 		return nil
 	}
@@ -62,12 +69,22 @@ func (s *LogSync) watchTlogDir() {
 				}
 				if ev.Op&fsnotify.Write == fsnotify.Write {
 					log.Println("写入文件 : ", ev.Name)
+					//跟踪模式下读取新写入的行，压缩文件没写完的话解压失败，写入后再试
+					if config.Ini.Tlog.Tail || len(compressExt(ev.Name)) > 0 {
+						s.fileChan <- ev.Name
+					}
 				}
 				if ev.Op&fsnotify.Remove == fsnotify.Remove {
 					log.Println("删除文件 : ", ev.Name)
+					if config.Ini.Tlog.Tail {
+						s.fileChan <- ev.Name
+					}
 				}
 				if ev.Op&fsnotify.Rename == fsnotify.Rename {
 					log.Println("重命名文件 : ", ev.Name)
+					if config.Ini.Tlog.Tail {
+						s.fileChan <- ev.Name
+					}
 				}
 				if ev.Op&fsnotify.Chmod == fsnotify.Chmod {
 					log.Println("修改权限 : ", ev.Name)